@@ -3,20 +3,28 @@ package base
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/bcrypt"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math/big"
 	"net"
 	"net/http"
 	"net/mail"
 	"net/smtp"
+	"net/url"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -34,11 +42,107 @@ type User struct {
 	ValidationString string
 	Ports            string
 	Server           string
+	// Role is one of Roles, an empty role is the user one
+	Role string
+	// Priority is the class of the web sessions, TokenPriority the one of the
+	// requests signed with the API key. Empty means the default class.
+	Priority      string
+	TokenPriority string
+	// Webhook is called when a server is held for the user into a wait queue
+	Webhook string
+	// Keys are the API key pairs of the user, TokenAuth and TokenSecret
+	// mirror the one named default which is given to the web interface
+	Keys []APIKey
+	// TOTPSecret is the base32 secret of the second factor, getToken only
+	// requires a code once TOTPEnabled. TOTPLastStep is the time step of the
+	// last code accepted, a code is used once. RecoveryCodes are hashed, each
+	// replaces a code once
+	TOTPSecret    string
+	TOTPEnabled   bool
+	TOTPLastStep  int64
+	RecoveryCodes []string
+	// OIDCSubject links the account to a user of the identity provider, it
+	// is the issuer and the subject of its ID tokens
+	OIDCSubject string
+	// LDAPDN is the entry of a directory account, its password is checked
+	// by the directory
+	LDAPDN string
+}
+
+//APIKey is a named API key pair, dates use the RFC1123Z format
+type APIKey struct {
+	Name      string
+	AccessKey string
+	SecretKey string
+	Created   string
+	LastUsed  string
+	// Scopes limit what the key can do, a key without scope can do
+	// everything. Expires is empty when the key doesn't expire
+	Scopes  []string
+	Expires string
+}
+
+//Roles of the users, each role has the permissions of the lower ones
+const (
+	RoleUser     = "user"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+//Roles are ordered from the lowest to the highest
+var Roles = []string{RoleUser, RoleOperator, RoleAdmin}
+
+//RoleRank returns the rank of a role into Roles, -1 if it is unknown. An
+//empty role is the user one
+func RoleRank(role string) int {
+	if role == "" {
+		return 0
+	}
+	for rank, known := range Roles {
+		if role == known {
+			return rank
+		}
+	}
+	return -1
+}
+
+//KeyScopes are the permissions an API key can be restricted to
+var KeyScopes = []string{"session", "build", "firmware:read", "power", "account", "admin"}
+
+//ValidScope tells if a scope is one of KeyScopes
+func ValidScope(scope string) bool {
+	for _, known := range KeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+//Expired tells if an API key is past its expiration date
+func (key APIKey) Expired() bool {
+	if key.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC1123Z, key.Expires)
+	return err != nil || time.Now().After(expires)
+}
+
+//Allows tells if an API key has a scope, a key without scope has them all
+func (key APIKey) Allows(scope string) bool {
+	if len(key.Scopes) == 0 {
+		return true
+	}
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
 }
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/")
 var simpleLetters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-var randInit = 0
 
 //MaxAge defines cookie expiration
 var MaxAge = 3600 * 24
@@ -46,26 +150,26 @@ var MaxAge = 3600 * 24
 //MaxServerAge  defines server allocation length : currently 60 seconds * 30 == 30 minutes
 var MaxServerAge = 60 * 30
 
-func randAlphaSlashPlus(n int) string {
-	if randInit == 0 {
-		rand.Seed(time.Now().UnixNano())
-	}
+//randString draws n letters from crypto/rand as the strings are secrets
+func randString(n int, set []rune) string {
 	b := make([]rune, n)
+	max := big.NewInt(int64(len(set)))
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b[i] = set[index.Int64()]
 	}
 	return string(b)
 }
 
+func randAlphaSlashPlus(n int) string {
+	return randString(n, letters)
+}
+
 func randAlpha(n int) string {
-	if randInit == 0 {
-		rand.Seed(time.Now().UnixNano())
-	}
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = simpleLetters[rand.Intn(len(simpleLetters))]
-	}
-	return string(b)
+	return randString(n, simpleLetters)
 }
 
 //GenerateAccountACKLink generates account verification link
@@ -309,6 +413,145 @@ func Request(method string, resURI string, Path string, Data string, content []b
 
 }
 
+//SignatureV2 is the Authorization scheme of the HMAC-SHA256 signatures
+const SignatureV2 = "OSF2"
+
+//NonceHeader carries the single use value of a v2 signature
+const NonceHeader = "X-Osf-Nonce"
+
+//VerifiedKeyHeader carries the access key which signed a request once the gateway checked it
+const VerifiedKeyHeader = "X-Osf-Verified-Key"
+
+//CanonicalQuery sorts the query parameters by name then by value and escapes them
+func CanonicalQuery(rawQuery string) string {
+	values, _ := url.ParseQuery(rawQuery)
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	escape := func(value string) string {
+		return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+	var pairs []string
+	for _, key := range keys {
+		list := values[key]
+		sort.Strings(list)
+		for _, value := range list {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+//BodyDigest returns the hex encoded SHA-256 of a request body
+func BodyDigest(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+//StringToSignV2 builds what a v2 signature covers
+func StringToSignV2(method string, Path string, rawQuery string, Data string, myDate string, nonce string, content []byte) string {
+	return SignatureV2 + "\n" + method + "\n" + Path + "\n" + CanonicalQuery(rawQuery) + "\n" +
+		Data + "\n" + myDate + "\n" + nonce + "\n" + BodyDigest(content)
+}
+
+//ComputeSignatureV2 returns the base64 encoded HMAC-SHA256 of a string to sign
+func ComputeSignatureV2(SecretKey string, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(SecretKey))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//SignRequestV2 signs a request with the v2 scheme, the date, a new nonce and
+//the digest of content are covered on top of the method, path and query
+func SignRequestV2(req *http.Request, content []byte, Key string, SecretKey string) {
+	myDate := time.Now().UTC().Format(http.TimeFormat)
+	myDate = strings.Replace(myDate, "GMT", "+0000", -1)
+	nonce := randAlpha(32)
+	stringToSign := StringToSignV2(req.Method, req.URL.Path, req.URL.RawQuery, req.Header.Get("Content-Type"), myDate, nonce, content)
+	req.Header.Set("myDate", myDate)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set("Authorization", SignatureV2+" "+Key+":"+ComputeSignatureV2(SecretKey, stringToSign))
+}
+
+//RequestV2 handler, same as Request with a v2 signature
+func RequestV2(method string, resURI string, Data string, content []byte, query string, Key string, SecretKey string) (*http.Response, error) {
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest(method, resURI, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", Data)
+	req.ContentLength = int64(len(content))
+	req.URL.RawQuery = query
+	SignRequestV2(req, content, Key, SecretKey)
+
+	return client.Do(req)
+}
+
+//TOTPPeriod is the lifetime in seconds of a TOTP code
+const TOTPPeriod = 30
+
+//TOTPStep returns the TOTP time step of a date
+func TOTPStep(date time.Time) int64 {
+	return date.Unix() / TOTPPeriod
+}
+
+//TOTPCode returns the 6 digits RFC 6238 code of a base32 secret for a time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+//PublicIP tells if an address is reachable from the internet, the loopback,
+//private, shared, link-local and multicast ones are not
+func PublicIP(ip net.IP) bool {
+	return !(ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+//PublicClient returns a client for the URLs given by the users. It only
+//connects to public addresses, once the names are resolved, and doesn't
+//follow the redirections
+func PublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
 // HTTPGetRequest handles some HTTP request
 // Get request to the storage backend
 func HTTPGetRequest(request string) string {
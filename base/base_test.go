@@ -0,0 +1,96 @@
+package base
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"sorted by name", "b=2&a=1", "a=1&b=2"},
+		{"repeated name sorted by value", "a=2&b=1&a=1", "a=1&a=2&b=1"},
+		{"name without value", "a=1&a", "a=&a=1"},
+		{"plus is a space", "q=c+d", "q=c%20d"},
+		{"encoded name and value", "a%20b=%2Fx%3Fy", "a%20b=%2Fx%3Fy"},
+		{"encoded and plain spellings match", "k=%7Ev&j=~w", "j=~w&k=~v"},
+		{"unicode", "n=%C3%A9", "n=%C3%A9"},
+	}
+	for _, test := range tests {
+		if got := CanonicalQuery(test.query); got != test.want {
+			t.Errorf("%s: CanonicalQuery(%q) = %q, want %q", test.name, test.query, got, test.want)
+		}
+	}
+}
+
+func TestBodyDigest(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"{}", "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},
+	}
+	for _, test := range tests {
+		if got := BodyDigest([]byte(test.content)); got != test.want {
+			t.Errorf("BodyDigest(%q) = %s, want %s", test.content, got, test.want)
+		}
+	}
+}
+
+func TestStringToSignV2(t *testing.T) {
+	const myDate = "Sat, 17 Oct 2026 03:45:14 +0000"
+	const nonce = "0123456789abcdef"
+	want := "OSF2\n" +
+		"PUT\n" +
+		"/user/alice/updateAccount\n" +
+		"a=1&b=2\n" +
+		"application/json\n" +
+		myDate + "\n" +
+		nonce + "\n" +
+		"44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	got := StringToSignV2("PUT", "/user/alice/updateAccount", "b=2&a=1", "application/json", myDate, nonce, []byte("{}"))
+	if got != want {
+		t.Fatalf("StringToSignV2 = %q, want %q", got, want)
+	}
+	if signature := ComputeSignatureV2("SK", got); signature != "7G58t2qL9g098to2gThdOaAGOGYawMCW1eNcCi5koPY=" {
+		t.Errorf("ComputeSignatureV2 = %s", signature)
+	}
+}
+
+// The RFC 6238 appendix B SHA-1 vectors, the codes are the last 6 of their 8 digits
+func TestTOTPCode(t *testing.T) {
+	// base32 of the ASCII secret 12345678901234567890
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		got, err := TOTPCode(secret, TOTPStep(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode at %d: %s", test.unix, err)
+		}
+		if got != test.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+	// The secrets are typed by the users
+	if got, _ := TOTPCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", TOTPStep(time.Unix(59, 0))); got != "287082" {
+		t.Errorf("TOTPCode of a lower case secret = %s, want 287082", got)
+	}
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Errorf("TOTPCode accepted a malformed secret")
+	}
+}
@@ -31,11 +31,11 @@ go mod init github.com/spf13
 go mod edit -replace base/base=$1/base
 go mod tidy
 echo "Building Server.go ...\n"
-go build $1/gateway/server.go
+go build -o server $1/gateway/server.go $1/gateway/server_*.go
 echo "Building ctrl1.go ...\n"
 go build $1/ctrl/ctrl1.go
 echo "Building user.go ...\n"
-go build $1/gateway/user.go
+go build -o user $1/gateway/user.go $1/gateway/user_*.go
 echo "Building storage.go ...\n"
 go build $1/gateway/backend/storage.go
 tar cvf gateway.tar $1/gateway/html $1/gateway/css/ $1/gateway/images/ $1/gateway/js
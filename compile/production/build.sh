@@ -12,9 +12,9 @@ echo $GOPATH
 go get golang.org/x/crypto/acme/autocert
 go get golang.org/x/sys/unix
 go get -v github.com/go-session/session
-go build $1/gateway/server.go
+go build -o server $1/gateway/server.go $1/gateway/server_*.go
 go build $1/ctrl/ctrl1.go
-go build $1/gateway/user.go
+go build -o user $1/gateway/user.go $1/gateway/user_*.go
 go build $1/gateway/backend/storage.go
 tar cvf gateway.tar $1/gateway/html $1/gateway/css/ $1/gateway/images/ $1/gateway/js
 \rm -rf tmp
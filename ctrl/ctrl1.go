@@ -4,15 +4,19 @@ package main
 
 import (
 	"base/base"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"strings"
 	"time"
@@ -31,6 +35,15 @@ var em100Bmc string
 var bmcSerial string
 var originalBmc string
 var originalBios string
+var ctrlTCPPort string
+var gatewayURI string
+var controllerSecret string
+var ctrlServername string
+var ctrlIP string
+var sutBmcIP string
+var sutType string
+var ctrlLabels string
+var heartbeatInterval time.Duration
 
 //OpenBMCEm100Command string
 var OpenBMCEm100Command *exec.Cmd = nil
@@ -64,10 +77,140 @@ func initCtrlconfig() error {
 	bmcSerial = viper.GetString("BMC_SERIAL")
 	originalBmc = viper.GetString("ORIGINAL_BMC")
 	originalBios = viper.GetString("ORIGINAL_BIOS")
+	ctrlTCPPort = viper.GetString("CTRL_TCPPORT")
+
+	// Registration to the gateway
+	gatewayURI = viper.GetString("GATEWAY_URI")
+	controllerSecret = viper.GetString("CONTROLLER_SECRET")
+	ctrlServername = viper.GetString("CTRL_SERVERNAME")
+	ctrlIP = viper.GetString("CTRL_IP")
+	sutBmcIP = viper.GetString("SUT_BMC_IP")
+	sutType = viper.GetString("SUT_TYPE")
+	ctrlLabels = viper.GetString("CTRL_LABELS")
+	heartbeatInterval = 30 * time.Second
+	if viper.IsSet("HEARTBEAT_INTERVAL") {
+		heartbeatInterval = time.Duration(viper.GetInt("HEARTBEAT_INTERVAL")) * time.Second
+	}
 
 	return nil
 }
 
+// gatewayRequest sends a request to the gateway controller port. The shared
+// secret goes with each request, so GATEWAY_URI is either an https:// URL or
+// a host:port reached over plain http on the lab network only
+func gatewayRequest(method string, command string, content []byte) (int, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	address := gatewayURI
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "http://" + address
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(address, "/")+"/controller/"+command, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Osfci-Secret", controllerSecret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// benchLabels returns the labels describing our test bench, CTRL_LABELS is a
+// comma separated list of key=value and the emulators label is set from
+// IS_EMULATORS_POOL if it is not given
+func benchLabels() map[string]string {
+	labels := make(map[string]string)
+	for _, term := range strings.Split(ctrlLabels, ",") {
+		pair := strings.SplitN(strings.TrimSpace(term), "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+			if strings.TrimSpace(term) != "" {
+				fmt.Printf("Ignoring malformed label %q\n", term)
+			}
+			continue
+		}
+		labels[strings.ToLower(strings.TrimSpace(pair[0]))] = strings.TrimSpace(pair[1])
+	}
+	if _, ok := labels["emulators"]; !ok {
+		labels["emulators"] = "no"
+		if isEmulatorsPool != "" {
+			labels["emulators"] = "yes"
+		}
+	}
+	return labels
+}
+
+// registerController announces our test bench to the gateway
+func registerController() error {
+	type controllerRegistration struct {
+		Servername string
+		IP         string
+		TCPPort    string
+		CompileIP  string
+		BMCIP      string
+		Product    string
+		Labels     map[string]string
+	}
+	var registration controllerRegistration
+	registration.Servername = ctrlServername
+	registration.IP = ctrlIP
+	registration.TCPPort = ctrlTCPPort
+	registration.CompileIP = compileURI
+	registration.BMCIP = sutBmcIP
+	registration.Product = sutType
+	registration.Labels = benchLabels()
+	content, _ := json.Marshal(registration)
+	status, err := gatewayRequest("POST", "register", content)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("gateway refused registration with status %d", status)
+	}
+	return nil
+}
+
+// gatewayHeartbeat keeps us into the gateway pool
+func gatewayHeartbeat() {
+	registered := false
+	for {
+		if !registered {
+			err := registerController()
+			if err != nil {
+				fmt.Printf("Registration error: %s\n", err)
+			} else {
+				fmt.Printf("Registered to gateway %s as %s\n", gatewayURI, ctrlServername)
+				registered = true
+			}
+		} else {
+			status, err := gatewayRequest("PUT", "heartbeat/"+ctrlServername, nil)
+			if err != nil {
+				fmt.Printf("Heartbeat error: %s\n", err)
+			} else if status == http.StatusNotFound {
+				// The gateway forgot about us
+				registered = false
+				continue
+			}
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// unregisterOnExit takes us out of the gateway pool when we are stopped
+func unregisterOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, unix.SIGTERM)
+	<-signals
+	_, err := gatewayRequest("DELETE", "unregister/"+ctrlServername, nil)
+	if err != nil {
+		fmt.Printf("Unregistration error: %s\n", err)
+	}
+	os.Exit(0)
+}
+
 // ShiftPath cleans up path
 func ShiftPath(p string) (head, tail string) {
 	p = path.Clean("/" + p)
@@ -565,9 +708,14 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	var ctrlTCPPort = viper.GetString("CTRL_TCPPORT")
 	mux := http.NewServeMux()
 
+	// If a gateway is configured we register to it
+	if gatewayURI != "" {
+		go gatewayHeartbeat()
+		go unregisterOnExit()
+	}
+
 	// Highest priority must be set to the signed request
 	mux.HandleFunc("/", home)
 
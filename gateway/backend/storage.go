@@ -3,6 +3,7 @@ package main
 import (
 	"base/base"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/spf13/viper"
 	"io/ioutil"
@@ -202,6 +203,81 @@ func distrosCallback(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// documentCallback serves the JSON documents kept into a directory of the
+// storage root by the gateway and the credential service
+//   GET    /<prefix>/<name>  returns a document
+//   PUT    /<prefix>/<name>  stores a document
+//   DELETE /<prefix>/<name>  drops a document
+// The gateway keeps the state of its server pool into the pool directory, the
+// credential service indexes the access keys of the users into the keys
+// directory, each file holds the nickname owning the key, and keeps the
+// sessions into the sessions directory, each named after the digest of a
+// session cookie.
+
+func documentCallback(directory string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(r.URL.Path, "/")
+		if len(path) < 3 || path[2] == "" || strings.Contains(path[2], "..") {
+			http.Error(w, "401 Malformed URI", 401)
+			return
+		}
+		document := storageRoot + "/" + directory + "/" + path[2]
+		switch r.Method {
+		case http.MethodGet:
+			file.RLock()
+			content, err := ioutil.ReadFile(document)
+			file.RUnlock()
+			if err != nil {
+				fmt.Fprintf(w, "Error")
+				return
+			}
+			w.Write(content)
+		case http.MethodPut:
+			file.Lock()
+			defer file.Unlock()
+			_, err := os.Stat(storageRoot + "/" + directory)
+			if os.IsNotExist(err) {
+				_ = os.Mkdir(storageRoot+"/"+directory, os.ModePerm)
+			}
+			// We write into a temporary file first as to never leave
+			// a truncated document behind us if we crash
+			err = ioutil.WriteFile(document+".tmp", base.HTTPGetBody(r), os.ModePerm)
+			if err == nil {
+				err = os.Rename(document+".tmp", document)
+			}
+			if err != nil {
+				http.Error(w, "500 Can't store document", 500)
+			}
+		case http.MethodDelete:
+			file.Lock()
+			defer file.Unlock()
+			_ = os.Remove(document)
+		default:
+		}
+	}
+}
+
+// sessionCallback also lists the sessions with GET /session/
+
+func sessionCallback(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) != 3 || path[2] != "" || r.Method != http.MethodGet {
+		documentCallback("sessions")(w, r)
+		return
+	}
+	file.RLock()
+	files, _ := ioutil.ReadDir(storageRoot + "/sessions")
+	file.RUnlock()
+	list := []string{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".tmp") {
+			list = append(list, f.Name())
+		}
+	}
+	b, _ := json.Marshal(list)
+	w.Write(b)
+}
+
 func userCallback(w http.ResponseWriter, r *http.Request) {
 	var username string
 	var filecontent string
@@ -295,6 +371,9 @@ func main() {
 	fmt.Println("StorageTCPPORT =", StorageTCPPORT)
 	mux.HandleFunc("/user/", userCallback)
 	mux.HandleFunc("/distros/", distrosCallback)
+	mux.HandleFunc("/pool/", documentCallback("pool"))
+	mux.HandleFunc("/key/", documentCallback("keys"))
+	mux.HandleFunc("/session/", sessionCallback)
 
 	log.Fatal(http.ListenAndServe(StorageURI+StorageTCPPORT, mux))
 }
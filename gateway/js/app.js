@@ -3,6 +3,8 @@ var mylocalStorage = {};
 window.mylocalStorage = mylocalStorage;
 var BMCUP=0;
 var isPool=1;
+// sessionEvents is the gateway event stream replacing our polling loops
+var sessionEvents=null;
 
 function clearDocument(){
 	$(document.body).empty();
@@ -121,23 +123,69 @@ function start_ci(machine) {
 	// We request a test node to the gateway
 	// This request could be a little bit long
 	loadHTML("html/wait.html");
+	request_server(machine, "", null);
+}
+
+function stop_events() {
+	if ( sessionEvents != null ) {
+		sessionEvents.close();
+		sessionEvents = null;
+	}
+}
+
+function start_events() {
+	stop_events();
+	if ( window.EventSource ) {
+		sessionEvents = new EventSource(window.location.origin + '/ci/events');
+	}
+	return sessionEvents;
+}
+
+function request_server(machine, ticket, countdown) {
+
+	// While we are into the wait queue we must come back regularly
+	// with our ticket otherwise we lose our place, unless we asked to be
+	// notified when a server is held for us
         $.ajax({
                   type: "GET",
                   contentType: 'application/json',
-                  url: window.location.origin + '/ci/'+ 'getServer/' + machine,
+                  url: window.location.origin + '/ci/'+ 'getServer/' + machine + '/' + ticket + '?notify=1',
                   success: function(response){
 			var answer = JSON.parse(response);
+			if ( countdown != null ) {
+				clearInterval(countdown);
+			}
 			if ( answer.Waittime == "0" ) {
 				$('#waitMessage').remove();
+				$('#waitServer').remove();
 				run_ci(answer.Servername, parseInt(answer.RemainingTime));
 			} else {
 				console.log(response);
 				// We must display a warning message
-				loadHTML("html/waitserver.html");
+				if ( $('#waitServer').length == 0 ) {
+					loadHTML("html/waitserver.html");
+				}
 				// We can run a countdown and we can restart the start_ci if 
 				// the countdown arrive to 0
 				// Set the date we're counting down to
 				var secondWait = parseInt(answer.Waittime);
+				var secondPoll = 30;
+				$("#users").html(answer.Queue);
+				// The event stream keeps our place and tells us when a server
+				// is held for us, browsers without it keep polling
+				if ( start_events() != null ) {
+					sessionEvents.addEventListener('queue', function(e) {
+						var status = JSON.parse(e.data);
+						if ( status.Ticket == answer.Ticket && !status.Held ) {
+							$("#users").html(status.Queue);
+							secondWait = parseInt(status.Waittime);
+							return;
+						}
+						// We can claim our server or our ticket is gone
+						stop_events();
+						request_server(machine, answer.Ticket, x);
+					});
+				}
 				// Update the count down every 1 second
 			var x = setInterval(function() {
 				var days = Math.floor(secondWait / ( 60 * 60 * 24));
@@ -146,19 +194,41 @@ function start_ci(machine) {
   				var seconds = Math.floor((secondWait % ( 60)) );
 
   				$("#countdown").html(days + "d " + hours + "h " + minutes + "m " + seconds + "s");
-				$("#users").html(answer.Queue);
 				secondWait = secondWait - 1;
-				// If the count down is finished, write some text
-  				if (secondWait < 0) {
-				    // We stop the timer
-				    clearInterval(x);
+				secondPoll = secondPoll - 1;
+				// Our ticket must be refreshed
+				if (sessionEvents == null && (secondPoll == 0 || secondWait == 0)) {
+				    request_server(machine, answer.Ticket, x);
+				}
+				if (secondWait < 0) {
+				    secondWait = 0;
 				  }
 				}, 1000);
 			}
+                  },
+                  error: function(xhr){
+			// Quotas or no server for that model
+			stop_events();
+			if ( countdown != null ) {
+				clearInterval(countdown);
+			}
+			$('#waitMessage').remove();
+			$('#waitServer').remove();
+			alert(xhr.responseText);
                   }
         });
 }
 
+function show_bmc_button() {
+	$('#bmcbutton').css("display","");
+	$('#bmcbutton').on("click", function() {
+		// we must redirect to the home page
+		var win = window.open('https://'+window.location.hostname, '_blank');
+		win.focus();
+	});
+	BMCUP=1;
+}
+
 function run_ci(servername, RemainingSecond) {
 
 	// We received a test node we can start the CI in interactive
@@ -221,6 +291,21 @@ function run_ci(servername, RemainingSecond) {
 		});
 
 
+	// The event stream tells us when the BMC is up and keeps the counter
+	// in sync with our lease, browsers without it poll the BMC
+	if ( start_events() != null ) {
+		sessionEvents.addEventListener('bmc', function(e) {
+			var status = JSON.parse(e.data);
+			if ( status.Up == "1" && BMCUP == 0 ) {
+				show_bmc_button();
+			}
+		});
+		sessionEvents.addEventListener('lease', function(e) {
+			var status = JSON.parse(e.data);
+			RemainingSecond = parseInt(status.RemainingTime);
+		});
+	}
+
 	// The home button and most of the navbar button must be disabled
 
 	var x = setInterval(function() {
@@ -236,20 +321,14 @@ function run_ci(servername, RemainingSecond) {
 		   // Let's check if the BMC is up and running
 		   // if yes we can activate the Go to BMC Web interface button !
 
-		   if ( RemainingSecond % 60 == 0 && BMCUP == 0 ) {
+		   if ( sessionEvents == null && RemainingSecond % 60 == 0 && BMCUP == 0 ) {
 			$.ajax({
                                 type: "GET",
                                 contentType: 'application/json',
                                 url: window.location.origin + '/ci/bmcup',
                                 success: function(response){
 					if ( response == "\"1\"" ) {
-						$('#bmcbutton').css("display","");
-						$('#bmcbutton').on("click", function() {
-							// we must redirect to the home page
-							var win = window.open('https://'+window.location.hostname, '_blank');
-							win.focus();
-						});
-						BMCUP=1;
+						show_bmc_button();
 					}
 				}
 			});	
@@ -264,6 +343,7 @@ function run_ci(servername, RemainingSecond) {
                    if (RemainingSecond < 0) {
                         // We stop the timer
                         clearInterval(x);
+			stop_events();
 			// We have to reset the server and go back home !
 	                $('#bmcem100console').contents().find("head").remove();
        		        $('#bmcem100console').contents().find("body").remove();
@@ -344,6 +424,7 @@ function run_ci(servername, RemainingSecond) {
                                           success: function(response){
                                                 // we move back to the main page
 						clearInterval(x);
+						stop_events();
 						$("#EndSession").css("display","none");
 						$("#modalSession").modal('hide');
 						$('#modalSession').on('hidden.bs.modal', function (e) {
@@ -851,6 +932,11 @@ function logged()
 
 function disconnect()
 {
+	// The session cookie is ended by the credential service
+	$.ajax({
+		type: "POST",
+		url: window.location.origin + '/user/' + mylocalStorage['username'] + '/logout',
+	});
 	delete mylocalStorage['accessKey'];
 	delete mylocalStorage['secretKey'];
 	delete mylocalStorage['username'];
@@ -899,10 +985,31 @@ function main(){
 		loadHTML("html/loginForm.html");
 		loadJS("js/login.js");
 		managePasswordForgotten();
+		manageSingleSignOn();
 		loadJS("js/forms.js");
 		formSubmission('#login','getToken','','Password missmatch');
 		loadHTML("html/footer.html");
 	}
+	else if ( getUrlParameter('ssoLogin') == "1" )
+	{
+		// The identity provider signed us in, our session cookie gets the key pair
+		mylocalStorage['username'] = getUrlParameter('username');
+		var jqxhr = $.post('/user/' + mylocalStorage['username'] + '/getToken', '',
+			function postreturn(data) {
+				var obj = JSON.parse( data );
+				var myarray = Object.keys(obj);
+				for (let i = 0; i  < myarray.length; i++) {
+					mylocalStorage[myarray[i]] = obj[myarray[i]];
+				}
+				logged();
+			},
+			'text'
+		);
+		jqxhr.fail( function() {
+			delete mylocalStorage['username'];
+			mainpage();
+		});
+	}
 	else
 	{
 		if ( getUrlParameter('resetPassword') == "1" )
@@ -55,7 +55,16 @@ function formSubmission(id, fn, successMsg, errorMsg) {
 			},
                         'text'
 		);
-		jqxhr.fail( function() {
+		jqxhr.fail( function(xhr) {
+			// The authentication code is asked once the password is right
+			if (( xhr.responseText.indexOf("Second factor required") != -1 ) && ( $('#otp').length ))
+			{
+				$('#otp').show();
+				$('#otp').focus();
+				$("#formAnswer").css('color', 'black');
+				$("#formAnswer").text("Please enter the code of your authenticator or a recovery code");
+				return;
+			}
 			$("#formAnswer").css('color', 'red');
 			$("#formAnswer").text("Auth Error");
 		});
@@ -15,3 +15,16 @@ function managePasswordForgotten() {
                 loadHTML("footer.html");
 	});
 }
+
+function manageSingleSignOn() {
+	// The single sign-on button is only shown when an identity provider is configured
+	$.ajax({
+		type: "GET",
+		url: window.location.origin + '/user/sso/oidcProvider',
+		success: function(response){
+			var obj = JSON.parse(response);
+			$('#ssoLogin').text('Sign in with ' + obj.Name);
+			$('#ssoLogin').show();
+		}
+	});
+}
@@ -259,6 +259,30 @@ function myAccountCol1createControl()
                    data: myJSON,
                    contentType: 'application/json',
                    success: function(response) {
+			// The webhook is saved along with the other changes
+			var webhook = response.includes('webhook');
+			response = response.replace('webhook', '');
+			if ( response == '' && webhook ) {
+				form="<center><h1> Webhook updated </h1>";
+				form=form+"<h3>Redirecting in 5s<h3>";
+				$('#col1').html(form);
+				$('#col2').html('');
+				$('#col0').html('');
+				setTimeout(function () {
+					myAccount();
+				}, 5000);
+			}
+			if ( response == 'error webhook' ) {
+				form='<center><h1 style="color: #FF0000"> Webhook error </h1>';
+				form=form + "<h2> The webhook must be an http or https URL </h2></center>";
+				form=form+"<h3>Redirecting in 5s<h3>";
+				$('#col1').html(form);
+				$('#col2').html('');
+				$('#col0').html('');
+				setTimeout(function () {
+					myAccount();
+				}, 5000);
+			}
 			if ( response == 'email' || response == 'passwordemail' ) {
 				// We must clear the window and close the session
 				// inform the end user
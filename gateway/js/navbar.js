@@ -62,6 +62,7 @@ function loginBtn() {
 			       	loadHTML("html/loginForm.html");
 		       		loadJS("js/login.js");
 		        	managePasswordForgotten();
+		        	manageSingleSignOn();
 		        	loadJS("js/forms.js");
 		        	formSubmission('#login','getToken','','Password missmatch');
 		        	loadHTML("footer.html");
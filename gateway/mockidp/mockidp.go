@@ -0,0 +1,221 @@
+// OSFCI mock OpenID Connect provider
+//
+// A provider for the development and the tests of the single sign-on of the
+// credential service. It signs in every user without asking a password:
+//   go run gateway/mockidp/mockidp.go -issuer http://localhost:9400
+// and into gatewayconf.yaml
+//   OIDC_ISSUER: http://localhost:9400
+//   OIDC_CLIENT_ID: osfci
+//   OIDC_CLIENT_SECRET: secret
+// The user is the one given on the command line, a login_hint of the
+// authorization request replaces its name. With -form the provider shows a
+// page where the name and the email of the user are typed. The signing key
+// is generated at each start.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var issuer = flag.String("issuer", "http://localhost:9400", "issuer URL, the provider listens on its port")
+var clientID = flag.String("client-id", "osfci", "client id of the credential service")
+var clientSecret = flag.String("client-secret", "secret", "client secret of the credential service")
+var nickname = flag.String("user", "mockuser", "preferred_username of the user")
+var email = flag.String("email", "mockuser@example.com", "email of the user")
+var emailVerified = flag.Bool("email-verified", true, "tell the email is verified")
+var form = flag.Bool("form", false, "ask the user name and email instead of signing in at once")
+
+var signingKey *rsa.PrivateKey
+var keyID string
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	redirect  string
+	nonce     string
+	challenge string
+	user      string
+	email     string
+	expire    time.Time
+}
+
+var grants = make(map[string]grant)
+var grantsLock sync.Mutex
+
+var formPage = template.Must(template.New("form").Parse(`<html><body><form method="POST">
+<p>Mock identity provider</p>
+<input name="user" value="{{.User}}"> <input name="email" value="{{.Email}}">
+{{range $name, $value := .Query}}<input type="hidden" name="{{$name}}" value="{{index $value 0}}">{{end}}
+<button type="submit">Sign in</button></form></body></html>`))
+
+// random returns a random URL safe value
+func random() string {
+	data := make([]byte, 24)
+	io.ReadFull(rand.Reader, data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// encode returns the base64url encoding of a JSON document
+func encode(document interface{}) string {
+	content, _ := json.Marshal(document)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                *issuer,
+		"authorization_endpoint":                *issuer + "/authorize",
+		"token_endpoint":                        *issuer + "/token",
+		"jwks_uri":                              *issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(signingKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(signingKey.E)).Bytes()),
+		}},
+	})
+}
+
+func authorize(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	query := r.Form
+	if query.Get("client_id") != *clientID || query.Get("response_type") != "code" || query.Get("redirect_uri") == "" {
+		http.Error(w, "400 Bad authorization request", 400)
+		return
+	}
+	user := *nickname
+	if query.Get("login_hint") != "" {
+		user = query.Get("login_hint")
+	}
+	mail := *email
+	if *form {
+		if r.Method != http.MethodPost {
+			formPage.Execute(w, map[string]interface{}{"User": user, "Email": mail, "Query": r.URL.Query()})
+			return
+		}
+		user = r.PostForm.Get("user")
+		mail = r.PostForm.Get("email")
+	}
+	code := random()
+	grantsLock.Lock()
+	grants[code] = grant{query.Get("redirect_uri"), query.Get("nonce"), query.Get("code_challenge"), user, mail, time.Now().Add(time.Minute)}
+	grantsLock.Unlock()
+	fmt.Printf("Signed in %s <%s>\n", user, mail)
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func token(w http.ResponseWriter, r *http.Request) {
+	fail := func(message string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+	}
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.FormValue("client_id")
+		secret = r.FormValue("client_secret")
+	}
+	if id != *clientID || secret != *clientSecret {
+		fail("invalid_client")
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		fail("unsupported_grant_type")
+		return
+	}
+	grantsLock.Lock()
+	code, found := grants[r.FormValue("code")]
+	delete(grants, r.FormValue("code"))
+	grantsLock.Unlock()
+	if !found || time.Now().After(code.expire) || code.redirect != r.FormValue("redirect_uri") {
+		fail("invalid_grant")
+		return
+	}
+	if code.challenge != "" {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			fail("invalid_grant")
+			return
+		}
+	}
+	header := encode(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	claims := encode(map[string]interface{}{
+		"iss":                *issuer,
+		"sub":                "mock-" + code.user,
+		"aud":                *clientID,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":              code.nonce,
+		"email":              code.email,
+		"email_verified":     *emailVerified,
+		"preferred_username": code.user,
+	})
+	digest := sha256.Sum256([]byte(header + "." + claims))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, signingKey, crypto.SHA256, digest[:])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+func main() {
+	flag.Parse()
+	var err error
+	signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyID = random()[:8]
+	address, err := url.Parse(*issuer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	prefix := strings.TrimSuffix(address.Path, "/")
+	mux.HandleFunc(prefix+"/.well-known/openid-configuration", discovery)
+	mux.HandleFunc(prefix+"/jwks", jwks)
+	mux.HandleFunc(prefix+"/authorize", authorize)
+	mux.HandleFunc(prefix+"/token", token)
+	fmt.Printf("Mock identity provider %s for client %s\n", *issuer, *clientID)
+	log.Fatal(http.ListenAndServe(":"+address.Port(), mux))
+}
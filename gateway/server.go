@@ -5,10 +5,7 @@ package main
 import (
 	"base/base"
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/spf13/viper"
@@ -22,7 +19,6 @@ import (
 	"net/url"
 	"path"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -63,6 +59,10 @@ type serverProduct struct {
 	Product string
 	Brand   string
 	Active  int
+	// Lease policy, lengths are in seconds
+	LeaseLength     int
+	LeaseMaxLength  int
+	LeaseExtensions int
 }
 
 var ciServersProducts []serverProduct
@@ -73,16 +73,42 @@ type serverEntry struct {
 	tcpPort      string
 	compileIP    string
 	bmcIP        string
+	labels       map[string]string
 	currentOwner string
+	// Usage is accounted to the nickname owning the session
+	ownerNickname string
+	// Priority class of the owner, a preempted lease ends after a grace period
+	priority  string
+	preempted bool
+	// Servers allocated together share their lease
+	group        string
+	guests       []sessionGuest
 	gitToken     string
-	queue        int
 	expiration   time.Time
+	leaseStart   time.Time
+	extensions   int
 	ProductIndex int
+	// Lifecycle, servers are only allocated when they are free
+	state        serverLifecycle
+	transitions  []serverTransition
+	drain        bool
+	cleanupRetry time.Time
+	cleanupFails int
+	// Registered controllers send heartbeats
+	dynamic       bool
+	retired       bool
+	lastHeartbeat time.Time
+	// Health probes, quarantined servers are not allocated
+	quarantined   bool
+	probeFailures int
+	probeError    string
+	lastProbe     time.Time
+	bmcReachable  bool
 }
 
+// ciServers is owned by the pool goroutine (see withPool)
 type serversList struct {
 	servers []serverEntry
-	mux     sync.Mutex
 }
 
 var ciServers serversList
@@ -130,6 +156,59 @@ func initServerconfig() error {
 
 	//StorageTCPPORT set from config file
 	StorageTCPPORT = viper.GetString("STORAGE_TCPPORT")
+
+	controllerTCPPort = viper.GetString("CONTROLLER_TCPPORT")
+	controllerSecret = viper.GetString("CONTROLLER_SECRET")
+
+	// Health probes
+	if viper.IsSet("HEALTH_INTERVAL") {
+		healthInterval = time.Duration(viper.GetInt("HEALTH_INTERVAL")) * time.Second
+	}
+	if viper.IsSet("HEALTH_FAILURES") {
+		healthFailures = viper.GetInt("HEALTH_FAILURES")
+	}
+	healthProbeBMC = viper.GetBool("HEALTH_PROBE_BMC")
+	operatorEmail = viper.GetString("OPERATOR_EMAIL")
+
+	// Quotas, durations are in hours except the cooldown which is in seconds
+	quotaMaxServers = viper.GetInt("QUOTA_MAX_SERVERS")
+	quotaPerDay = time.Duration(viper.GetFloat64("QUOTA_HOURS_PER_DAY") * float64(time.Hour))
+	quotaPerWeek = time.Duration(viper.GetFloat64("QUOTA_HOURS_PER_WEEK") * float64(time.Hour))
+	quotaCooldown = time.Duration(viper.GetInt("QUOTA_COOLDOWN")) * time.Second
+	if viper.IsSet("FAIRSHARE_WINDOW") {
+		fairShareWindow = time.Duration(viper.GetFloat64("FAIRSHARE_WINDOW") * float64(time.Hour))
+	}
+
+	// Priority classes, the grace period is in seconds
+	if priorityRank(viper.GetString("PRIORITY_DEFAULT")) != -1 {
+		defaultPriority = viper.GetString("PRIORITY_DEFAULT")
+	}
+	preemptionGrace = time.Duration(viper.GetInt("PREEMPTION_GRACE")) * time.Second
+	if viper.IsSet("PREEMPTING_CLASSES") {
+		preemptingClasses = parseClasses(viper.GetString("PREEMPTING_CLASSES"))
+	}
+
+	// Queue notifications, the claim window is in seconds and the ticket timeout in hours
+	if viper.GetInt("CLAIM_WINDOW") > 0 {
+		claimWindow = time.Duration(viper.GetInt("CLAIM_WINDOW")) * time.Second
+	}
+	if viper.GetFloat64("NOTIFY_TICKET_TIMEOUT") > 0 {
+		notifyTicketTimeout = time.Duration(viper.GetFloat64("NOTIFY_TICKET_TIMEOUT") * float64(time.Hour))
+	}
+	notifyEmail = viper.GetBool("QUEUE_NOTIFY_EMAIL")
+
+	// Request signatures, the skew is in seconds
+	if viper.GetInt("SIGNATURE_SKEW") > 0 {
+		signatureSkew = time.Duration(viper.GetInt("SIGNATURE_SKEW")) * time.Second
+	}
+	if viper.IsSet("SIGNATURE_V1") {
+		signatureV1 = viper.GetBool("SIGNATURE_V1")
+	}
+
+	// Session checks, the cache lifetime is in seconds
+	if viper.IsSet("SESSION_CACHE_TTL") {
+		sessionCacheTTL = time.Duration(viper.GetInt("SESSION_CACHE_TTL")) * time.Second
+	}
 	return nil
 }
 
@@ -152,64 +231,84 @@ func ShiftPath(p string) (head, tail string) {
 	return p[1:i], p[i:]
 }
 
-func checkAccess(w http.ResponseWriter, r *http.Request, login string, command string) bool {
-	switch command {
-	case "getToken":
-		return r.Method == http.MethodGet || r.Method == http.MethodPost
-	case "validateUser":
-		return true
-	case "resetPassword":
-		return true
-	case "generatePasswordLnkRst":
-		return true
-	case "createUser":
-		return true
-	}
-	if r.Header.Get("Authorization") != "" {
-		var method string
-		switch r.Method {
-		case http.MethodGet:
-			method = "GET"
-		case http.MethodPut:
-			method = "PUT"
-		case http.MethodPost:
-			method = "POST"
-		case http.MethodDelete:
-			method = "DELETE"
-		}
-		// Is this an AWS request ?
-		words := strings.Fields(r.Header.Get("Authorization"))
-		if words[0] == "OSF" {
-			// Let's dump the various content
-			keys := strings.Split(words[1], ":")
-			// We must retrieve the secret key used for encryption and calculate the header
-			// if everything is ok (aka our computed value match) we are good
-
-			username := login
-
-			result := base.HTTPGetRequest("http://" + r.Host + ":9100" + "/user/" + username + "/userGetInternalInfo")
-
-			var returnData *base.User
-			returnData = new(base.User)
-			json.Unmarshal([]byte(result), returnData)
-
-			// I am getting the Secret Key and the Nickname
-			stringToSign := method + "\n\n" + r.Header.Get("Content-Type") + "\n" + r.Header.Get("myDate") + "\n" + r.URL.Path
-
-			secretKey := returnData.TokenSecret
-			nickname := username
-			if nickname != login {
-				return false
-			}
-			mac := hmac.New(sha1.New, []byte(secretKey))
-			mac.Write([]byte(stringToSign))
-			expectedMAC := mac.Sum(nil)
-			if base64.StdEncoding.EncodeToString(expectedMAC) == keys[1] {
-				return true
-			}
+// productIndex returns the index of a product into ciServersProducts
+func productIndex(product string) int {
+	for i := range ciServersProducts {
+		if ciServersProducts[i].Product == product {
+			return i
 		}
 	}
-	return false
+	return -1
+}
+
+func checkAccess(w http.ResponseWriter, r *http.Request, login string, command string) bool {
+	// Only the gateway tells which key signed a request
+	r.Header.Del(base.VerifiedKeyHeader)
+	// The public commands are not signed, except the getToken of a robot
+	// opening its session with its key instead of a password
+	if commandPermissions[command] == permissionPublic && !(command == "getToken" && tokenLogin(r)) {
+		return publicRequest(r, command)
+	}
+	key, ok := signingKey(r, login)
+	if !ok {
+		return false
+	}
+	if strings.Fields(r.Header.Get("Authorization"))[0] == base.SignatureV2 && !useSignatureNonce(r, login) {
+		return false
+	}
+	return authorizeKey(r, key, command)
+}
+
+// getAccount asks the credential service the record of a user
+func getAccount(login string) (base.User, bool) {
+	var account base.User
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + credentialURI + credentialPort + "/user/" + url.PathEscape(login) + "/userGetInternalInfo")
+	if err != nil {
+		fmt.Printf("Can't reach credential service: %s\n", err)
+		return account, false
+	}
+	defer resp.Body.Close()
+	if json.NewDecoder(resp.Body).Decode(&account) != nil || account.Nickname != login {
+		return account, false
+	}
+	return account, true
+}
+
+// accessKey is an access key, its owner and the role of its owner
+// Upercase is mandatory for JSON library parsing
+type accessKey struct {
+	Nickname string
+	Role     string
+	base.APIKey
+}
+
+// lookupKey asks the credential service the secret of an access key owned by login
+func lookupKey(key string, login string) (accessKey, bool) {
+	var found accessKey
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + credentialURI + credentialPort + "/key/" + url.PathEscape(key) + "?login=" + url.QueryEscape(login))
+	if err != nil {
+		fmt.Printf("Can't reach credential service: %s\n", err)
+		return found, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&found) != nil {
+		return found, false
+	}
+	return found, found.Nickname == login && found.SecretKey != ""
+}
+
+// markKeyUsed records the use of an access key
+func markKeyUsed(key string) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	request, _ := http.NewRequest(http.MethodPut, "http://"+credentialURI+credentialPort+"/key/"+url.PathEscape(key)+"/used", nil)
+	resp, err := client.Do(request)
+	if err != nil {
+		fmt.Printf("Can't reach credential service: %s\n", err)
+		return
+	}
+	resp.Body.Close()
 }
 
 func user(w http.ResponseWriter, r *http.Request) {
@@ -242,41 +341,52 @@ func user(w http.ResponseWriter, r *http.Request) {
 
 	// Note that ServeHttp is non blocking and uses a go routine under the hood
 	proxy.ServeHTTP(w, r)
+
+	// The session of a logout is not trusted any longer
+	if command == "logout" {
+		if cookie, err := r.Cookie("osfci_cookie"); err == nil {
+			forgetSession(cookie.Value)
+		}
+	}
+}
+
+// resetServer powers off the SUT and cleans up its compile node
+// as to get it ready for the next user
+func resetServer(entry serverEntry) error {
+	client := &http.Client{Timeout: 120 * time.Second}
+	for _, request := range []string{
+		"http://" + entry.ip + entry.tcpPort + "/poweroff",
+		"http://" + entry.compileIP + compileTCPPort + "/cleanUp",
+	} {
+		resp, err := client.Get(request)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", request, resp.Status)
+		}
+	}
+	return nil
 }
 
 func home(w http.ResponseWriter, r *http.Request) {
 
 	// The cookie allow us to track the current
-	// user on the node
-	cookie, cookieErr := r.Cookie("osfci_cookie")
+	// user on the node, it is ignored if its session is over
+	cookie, cookieErr := sessionCookie(r)
 	cacheIndex := -1
 	// We have to find the entry into the cache
 	// if the cookie exist and return a Value
+	// owned is a copy of that entry, the pool itself is only
+	// accessed through withPool
+	var owned serverEntry
+	// role tells if we own the server or if it is shared with us
+	var role sessionRole
 
 	if cookieErr == nil {
 		if cookie.Value != "" {
-			for i := range ciServers.servers {
-				if ciServers.servers[i].currentOwner == cookie.Value {
-					// Before indexing we must validate that the server is still ours
-					if time.Now().After(ciServers.servers[i].expiration) {
-						ciServers.mux.Lock()
-						ciServers.servers[i].expiration = time.Now()
-						ciServers.servers[i].currentOwner = ""
-						ciServers.servers[i].gitToken = ""
-						// We have to reset the associated compile node and associated ctrl node
-						client := &http.Client{}
-						var req *http.Request
-						req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].ip+ciServers.servers[i].tcpPort+"/poweroff", nil)
-						_, _ = client.Do(req)
-						client = &http.Client{}
-						req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].compileIP+"/cleanUp", nil)
-						_, _ = client.Do(req)
-						ciServers.mux.Unlock()
-					} else {
-						cacheIndex = i
-					}
-				}
-			}
+			cacheIndex, owned, role = ownedServer(cookie.Value, r.URL.Query().Get("server"))
 		}
 	}
 
@@ -284,6 +394,18 @@ func home(w http.ResponseWriter, r *http.Request) {
 	if head == "ci" {
 		head, _ = ShiftPath(tail)
 	}
+	// Guests only run the session commands their access allows
+	// and what is done on the server is recorded
+	if cacheIndex != -1 {
+		if !commandAllowed(head, role.access) {
+			cacheIndex = -1
+		} else if sessionCommand(head) && !sessionAllows(cookie.Value, head) {
+			// A session opened with a scoped key only runs the commands of its scopes
+			cacheIndex = -1
+		} else {
+			auditCommand(r, head, owned.servername, role)
+		}
+	}
 	// Some commands are superseed by a username so we shall identify
 	// if that is the case. If the command is unknown then we can assume
 	// we are getting a username as a head parameter and must get the
@@ -310,11 +432,13 @@ func home(w http.ResponseWriter, r *http.Request) {
 		var serverTypeIndex int
 		serverTypeIndex = -1
 		_, tail := ShiftPath(tail)
-		serverType, _ := ShiftPath(tail)
-		for i := range ciServersProducts {
-			if ciServersProducts[i].Product == serverType {
-				serverTypeIndex = i
-			}
+		serverType, tail := ShiftPath(tail)
+		// A client waiting into the queue is sending back its ticket
+		ticketID, _ := ShiftPath(tail)
+		serverTypeIndex = productIndex(serverType)
+		if serverTypeIndex == -1 {
+			http.Error(w, "404 Unknown server model", 404)
+			return
 		}
 		// We need to have a valid cookie and associated Public Key / Private Key otherwise
 		// We can't request a server
@@ -327,79 +451,175 @@ func home(w http.ResponseWriter, r *http.Request) {
 					Waittime      string
 					Queue         string
 					RemainingTime string
+					Ticket        string
 				}
 				var myoutput returnValue
-				actualTime := time.Now().Add(time.Second * 3600 * 365 * 10)
-				index := 0
-				ciServers.mux.Lock()
-				for i := range ciServers.servers {
-					if time.Now().After(ciServers.servers[i].expiration) {
-						if ciServers.servers[i].ProductIndex == serverTypeIndex {
-							// the server is available we can allocate it
-							ciServers.servers[i].expiration = time.Now().Add(time.Second * time.Duration(base.MaxServerAge))
-							ciServers.servers[i].currentOwner = cookie.Value
-							ciServers.mux.Unlock()
-
-							myoutput.Servername = ciServers.servers[i].servername
-							myoutput.Waittime = "0"
-							myoutput.RemainingTime = fmt.Sprintf("%d", base.MaxServerAge)
-							returnData, _ := json.Marshal(myoutput)
-							if ciServers.servers[i].queue > 0 {
-								ciServers.servers[i].queue = ciServers.servers[i].queue - 1
-							}
-							// We probably need to turn it off just to clean it
-							client := &http.Client{}
-							var req *http.Request
-							req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].ip+ciServers.servers[i].tcpPort+"/poweroff", nil)
-							_, _ = client.Do(req)
-							client = &http.Client{}
-							req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].compileIP+"/cleanUp", nil)
-							_, _ = client.Do(req)
-							w.Write([]byte(returnData))
-							return
+				// Reservations and quotas are tracked by nickname
+				nickname := cookieOwner(cookie.Value)
+				if nickname == "" {
+					http.Error(w, "401 Unknown session, please log in again", 401)
+					return
+				}
+				// The pool goroutine does the allocation, we answer once it is done
+				var entry serverEntry
+				allocated := false
+				newLease := false
+				noServer := false
+				var quotaErr error
+				var warnings []preemption
+				// A client polling again keeps the class of its ticket
+				priority := ""
+				withPool(func() {
+					if position := findTicket(serverTypeIndex, cookie.Value, ticketID); position != -1 {
+						priority = waitQueues[serverTypeIndex][position].Priority
+					}
+				})
+				if priority == "" {
+					priority = requestPriority(r, cookie.Value, nickname)
+				}
+				// Labels the server must carry on top of its model
+				selector := r.URL.Query().Get("selector")
+				constraints, err := parseSelector(selector)
+				if err != nil {
+					http.Error(w, "400 Malformed selector, "+err.Error(), 400)
+					return
+				}
+				var selectorErr error
+				withPool(func() {
+					// We can check also if the user is just coming back ?
+					// their could be a case where the user reloaded it's session
+					// we can bring it back the server for his own usage
+					if cacheIndex != -1 && ciServers.servers[cacheIndex].ProductIndex == serverTypeIndex &&
+						ciServers.servers[cacheIndex].state == serverAllocated && ciServers.servers[cacheIndex].group == "" &&
+						ciServers.servers[cacheIndex].currentOwner == cookie.Value {
+						entry = ciServers.servers[cacheIndex]
+						allocated = true
+						return
+					}
+					pruneTickets()
+					pruneReservations()
+					pruneUsages()
+					quotaErr = quotaCheck(nickname)
+					if quotaErr != nil {
+						return
+					}
+					selectorErr = unsatisfiableSelector(serverTypeIndex, constraints)
+					if selectorErr != nil {
+						return
+					}
+					fairShareOrder(serverTypeIndex)
+					position := findTicket(serverTypeIndex, cookie.Value, ticketID)
+					if position == -1 {
+						position = len(waitQueues[serverTypeIndex])
+					}
+					free := matchingServers(freeServers(serverTypeIndex), constraints)
+					leaseEnd := time.Now().Add(leaseLength(serverTypeIndex))
+					// Servers are kept for the bookings which will start during our lease
+					available := len(free) - reservedServers(serverTypeIndex, time.Now(), leaseEnd)
+					booked := false
+					booking := findActiveReservation(serverTypeIndex, nickname)
+					if booking != -1 && len(free) > 0 {
+						// The booking owner doesn't wait, one of the servers kept
+						// for the bookings is its own. The server is kept up to the
+						// end of the slot within the lease length limit
+						booked = true
+						leaseEnd = reservations[booking].End
+						if maxEnd := time.Now().Add(leaseMaxLength(serverTypeIndex)); leaseEnd.After(maxEnd) {
+							leaseEnd = maxEnd
 						}
-						// We can check also if the user is just coming back ?
-						// their could be a case where the user reloaded it's session
-						// we can bring it back the server for his own usage
-						if ciServers.servers[i].currentOwner == cookie.Value {
-							// let's give it back to the user after a cleaning
-							client := &http.Client{}
-							var req *http.Request
-							req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].ip+ciServers.servers[i].tcpPort+"/poweroff", nil)
-							_, _ = client.Do(req)
-							client = &http.Client{}
-							req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].compileIP+"/cleanUp", nil)
-							_, _ = client.Do(req)
-							myoutput.Servername = ciServers.servers[i].servername
-							myoutput.Waittime = "0"
-							myoutput.RemainingTime = fmt.Sprintf("%d", ciServers.servers[i].expiration.Unix()-time.Now().Unix())
-							returnData, _ := json.Marshal(myoutput)
-							if ciServers.servers[i].queue > 0 {
-								ciServers.servers[i].queue = ciServers.servers[i].queue - 1
-							}
-							ciServers.mux.Unlock()
-							w.Write([]byte(returnData))
-							// We probably need to turn it off just to clean it
-							return
+						reservations[booking].Servername = ciServers.servers[free[0]].servername
+						reservations[booking].Cookie = cookie.Value
+						position = findTicket(serverTypeIndex, cookie.Value, "")
+						if position == -1 {
+							position = len(waitQueues[serverTypeIndex])
 						}
 					}
-					// used to calculate potential wait time
-					if ciServers.servers[i].ProductIndex == serverTypeIndex {
-						if actualTime.After(ciServers.servers[i].expiration) {
-							actualTime = ciServers.servers[i].expiration
-							index = i
+					// The lease can't go beyond the user quota
+					if left := quotaTimeLeft(nickname); left >= 0 && leaseEnd.After(time.Now().Add(left)) {
+						leaseEnd = time.Now().Add(left)
+					}
+					// Users ahead of us into the queue have precedence on free servers
+					// a user cooling down after a session has to wait
+					// users waiting for servers with other labels don't delay us
+					cooldown := cooldownLeft(nickname)
+					if (booked || ticketsAhead(serverTypeIndex, position, free) < available) && cooldown == 0 {
+						// the server is available we can allocate it
+						i := free[0]
+						if position < len(waitQueues[serverTypeIndex]) {
+							removeTicket(serverTypeIndex, position)
 						}
+						ciServers.servers[i].expiration = leaseEnd
+						ciServers.servers[i].leaseStart = time.Now()
+						ciServers.servers[i].extensions = 0
+						ciServers.servers[i].currentOwner = cookie.Value
+						ciServers.servers[i].ownerNickname = nickname
+						ciServers.servers[i].priority = priority
+						ciServers.servers[i].preempted = false
+						ciServers.servers[i].group = ""
+						startUsage(nickname, ciServers.servers[i].servername, leaseEnd)
+						setServerState(i, serverAllocated, "leased to "+nickname)
+						entry = ciServers.servers[i]
+						allocated = true
+						newLease = true
+						return
 					}
-
+					if countServers(serverTypeIndex) == 0 {
+						// There is no server at all for that product
+						noServer = true
+						return
+					}
+					if position == len(waitQueues[serverTypeIndex]) {
+						enqueueTicket(serverTypeIndex, cookie.Value, nickname, priority)
+						// A new high priority ticket may move ahead of the others
+						fairShareOrder(serverTypeIndex)
+						position = findTicket(serverTypeIndex, cookie.Value, "")
+					}
+					ticket := waitQueues[serverTypeIndex][position]
+					ticket.LastSeen = time.Now()
+					ticket.Priority = priority
+					ticket.Selector = selector
+					ticket.Notify = r.URL.Query().Get("notify") == "1"
+					if available < 0 {
+						available = 0
+					}
+					warnings = preemptServers(serverTypeIndex, available)
+					wait := estimateWait(serverTypeIndex, position, available)
+					if cooldown > wait {
+						wait = cooldown
+					}
+					myoutput.Waittime = fmt.Sprintf("%.0f", wait.Seconds())
+					myoutput.Queue = fmt.Sprintf("%d", position)
+					myoutput.Ticket = ticket.ID
+					savePoolState()
+				})
+				if len(warnings) > 0 {
+					go warnPreempted(warnings)
+				}
+				if quotaErr != nil {
+					http.Error(w, "429 "+quotaErr.Error(), 429)
+					return
+				}
+				if selectorErr != nil {
+					http.Error(w, "503 "+selectorErr.Error(), 503)
+					return
+				}
+				if noServer {
+					http.Error(w, "503 No server available for this model", 503)
+					return
+				}
+				if allocated {
+					myoutput.Servername = entry.servername
+					myoutput.Waittime = "0"
+					myoutput.RemainingTime = fmt.Sprintf("%d", entry.expiration.Unix()-time.Now().Unix())
+				} else {
+					myoutput.Servername = ""
+					myoutput.RemainingTime = fmt.Sprintf("%d", 0)
 				}
-				myoutput.Servername = ""
-				remainingTime := actualTime.Sub(time.Now())
-				myoutput.Waittime = fmt.Sprintf("%.0f", remainingTime.Seconds())
-				myoutput.Queue = fmt.Sprintf("%d", ciServers.servers[index].queue)
-				ciServers.servers[index].queue = ciServers.servers[index].queue + 1
-				ciServers.mux.Unlock()
-				myoutput.RemainingTime = fmt.Sprintf("%d", 0)
 				returnData, _ := json.Marshal(myoutput)
+				if newLease {
+					// We probably need to turn it off just to clean it
+					resetServer(entry)
+				}
 				w.Write([]byte(returnData))
 			}
 		}
@@ -410,24 +630,63 @@ func home(w http.ResponseWriter, r *http.Request) {
 		// Ok we must look for this server into the ciServer list
 		// we must validate that the cookie if the right one
 		if cookieErr == nil {
-			ciServers.mux.Lock()
-			for i := range ciServers.servers {
-				if ciServers.servers[i].servername == servername {
-					if ciServers.servers[i].currentOwner == cookie.Value {
-						// Ok we can free the server
-						// This is done by resetting the expiration
-						ciServers.servers[i].expiration = time.Now()
-						ciServers.servers[i].currentOwner = ""
-						ciServers.servers[i].gitToken = ""
-						client := &http.Client{}
-						var req *http.Request
-						req, _ = http.NewRequest("GET", "http://"+ciServers.servers[i].compileIP+compileTCPPort+"/cleanUp", nil)
-						_, _ = client.Do(req)
+			withPool(func() {
+				for i := range ciServers.servers {
+					// A group is released by its name or the name of any of its servers
+					if ciServers.servers[i].servername == servername ||
+						(ciServers.servers[i].group != "" && ciServers.servers[i].group == servername) {
+						if ciServers.servers[i].currentOwner == cookie.Value {
+							// Ok we can free the server
+							// This is done by resetting the expiration
+							// the reaper takes care of the cleanup
+							recordAudit(ciServers.servers[i].servername,
+								sessionRole{accessOwner, ciServers.servers[i].ownerNickname}, "stopServer")
+							endLease(i)
+						}
 					}
 				}
-			}
-			ciServers.mux.Unlock()
+			})
+			wakeReaper()
+		}
+	case "getServers":
+		_, tail := ShiftPath(tail)
+		if cookieErr != nil || cookie.Value == "" {
+			http.Error(w, "401 Unknown session, please log in again", 401)
+			return
+		}
+		groupCommand(w, r, tail, cookie.Value)
+	case "extendLease":
+		_, tail = ShiftPath(r.URL.Path)
+		leaseCommand(w, r, tail, cacheIndex)
+	case "reservation":
+		_, tail = ShiftPath(r.URL.Path)
+		reservationCommand(w, r, tail)
+	case "events":
+		if cookieErr != nil || cookie.Value == "" {
+			http.Error(w, "401 Unknown session, please log in again", 401)
+			return
+		}
+		eventsCommand(w, r, cookie.Value)
+	case "share":
+		_, tail = ShiftPath(r.URL.Path)
+		if cookieErr != nil || cookie.Value == "" {
+			http.Error(w, "401 Unknown session, please log in again", 401)
+			return
 		}
+		shareCommand(w, r, tail, cookie.Value)
+	case "admin":
+		_, tail = ShiftPath(r.URL.Path)
+		adminCommand(w, r, tail)
+	case "reservations":
+		_, tail := ShiftPath(tail)
+		product, _ := ShiftPath(tail)
+		returnData, _ := json.Marshal(publicReservations(product))
+		w.Write([]byte(returnData))
+	case "calendar":
+		_, tail := ShiftPath(tail)
+		product, _ := ShiftPath(tail)
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Write([]byte(reservationsCalendar(r.Host, publicReservations(product))))
 	case "getosinstallers":
 		// Must get a directory content from the storage backend if there is no further option
 		// if their is an option (aka a file name), it means that we have to inform the
@@ -452,24 +711,18 @@ func home(w http.ResponseWriter, r *http.Request) {
 			client := &http.Client{}
 			var req *http.Request
 
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/getosinstallers/"+path[3], nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/getosinstallers/"+path[3], nil)
 			_, _ = client.Do(req)
 		}
 	case "bmcup":
 		bmcIP := ""
 		var Up string
 		if cacheIndex != -1 {
-			bmcIP = ciServers.servers[cacheIndex].bmcIP
-		}
-		if bmcIP != "" {
-			conn, err := net.DialTimeout("tcp", bmcIP+":443", 220*time.Millisecond)
-			if err == nil {
-				conn.Close()
-				// The controller is up
-				Up = "1"
-			} else {
-				Up = "0"
-			}
+			bmcIP = owned.bmcIP
+		}
+		if bmcReachable(bmcIP) {
+			// The controller is up
+			Up = "1"
 		} else {
 			Up = "0"
 		}
@@ -478,22 +731,22 @@ func home(w http.ResponseWriter, r *http.Request) {
 	case "console":
 		if cacheIndex != -1 {
 			fmt.Printf("Console request\n")
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDHostConsole)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort + TTYDHostConsole)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDHostConsole
+			r.URL.Host = "http://" + owned.ip + owned.tcpPort + TTYDHostConsole
 			filePath := strings.Split(tail, "/")
 			r.URL.Path = "/"
 			if len(filePath) > 2 {
 				r.URL.Path = r.URL.Path + filePath[2]
 			}
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-			proxy.ServeHTTP(w, r)
+			serveConsole(w, r, proxy, url, role.access)
 		}
 	case "isRunning":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].compileIP + compileTCPPort)
+			url, _ := url.Parse("http://" + owned.compileIP + compileTCPPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].compileIP + compileTCPPort
+			r.URL.Host = "http://" + owned.compileIP + compileTCPPort
 			fmt.Printf("Tail %s\n", tail)
 			r.URL.Path = tail
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
@@ -501,7 +754,7 @@ func home(w http.ResponseWriter, r *http.Request) {
 		}
 	case "isEmulatorsPool":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
 			r.URL.Path = "/isEmulatorsPool"
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
@@ -509,7 +762,7 @@ func home(w http.ResponseWriter, r *http.Request) {
 		}
 	case "resetEmulator":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
 			r.URL.Path = tail
 			fmt.Printf(r.URL.Path)
@@ -518,62 +771,62 @@ func home(w http.ResponseWriter, r *http.Request) {
 		}
 	case "smbiosconsole":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDem100Bios)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort + TTYDem100Bios)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDem100Bios
+			r.URL.Host = "http://" + owned.ip + owned.tcpPort + TTYDem100Bios
 			filePath := strings.Split(tail, "/")
 			r.URL.Path = "/"
 			if len(filePath) > 2 {
 				r.URL.Path = r.URL.Path + filePath[2]
 			}
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-			proxy.ServeHTTP(w, r)
+			serveConsole(w, r, proxy, url, role.access)
 		}
 	case "smbiosbuildconsole":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].compileIP + ":7681")
+			url, _ := url.Parse("http://" + owned.compileIP + ":7681")
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].compileIP + TTYDem100Bios
+			r.URL.Host = "http://" + owned.compileIP + TTYDem100Bios
 			filePath := strings.Split(tail, "/")
 			r.URL.Path = "/"
 			if len(filePath) > 2 {
 				r.URL.Path = r.URL.Path + filePath[2]
 			}
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-			proxy.ServeHTTP(w, r)
+			serveConsole(w, r, proxy, url, role.access)
 		}
 	case "bmcbuildconsole":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].compileIP + ":7682")
+			url, _ := url.Parse("http://" + owned.compileIP + ":7682")
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].compileIP + TTYDem100BMC
+			r.URL.Host = "http://" + owned.compileIP + TTYDem100BMC
 			filePath := strings.Split(tail, "/")
 			r.URL.Path = "/"
 			if len(filePath) > 2 {
 				r.URL.Path = r.URL.Path + filePath[2]
 			}
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-			proxy.ServeHTTP(w, r)
+			serveConsole(w, r, proxy, url, role.access)
 		}
 	case "osloaderconsole":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDOSLoader)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort + TTYDOSLoader)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDOSLoader
+			r.URL.Host = "http://" + owned.ip + owned.tcpPort + TTYDOSLoader
 			filePath := strings.Split(tail, "/")
 			r.URL.Path = "/"
 			if len(filePath) > 2 {
 				r.URL.Path = r.URL.Path + filePath[2]
 			}
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-			proxy.ServeHTTP(w, r)
+			serveConsole(w, r, proxy, url, role.access)
 		}
 	case "poweron":
 		if cacheIndex != -1 {
 			fmt.Printf("Poweron request\n")
 			client := &http.Client{}
 			var req *http.Request
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/poweron", nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/poweron", nil)
 			_, _ = client.Do(req)
 		}
 	case "poweroff":
@@ -581,31 +834,31 @@ func home(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("Poweroff request\n")
 			client := &http.Client{}
 			var req *http.Request
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/poweroff", nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/poweroff", nil)
 			_, _ = client.Do(req)
 		}
 	case "bmcconsole":
 		if cacheIndex != -1 {
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDem100BMC)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort + TTYDem100BMC)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort + TTYDem100BMC
+			r.URL.Host = "http://" + owned.ip + owned.tcpPort + TTYDem100BMC
 			filePath := strings.Split(tail, "/")
 			r.URL.Path = "/"
 			if len(filePath) > 2 {
 				r.URL.Path = r.URL.Path + filePath[2]
 			}
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-			proxy.ServeHTTP(w, r)
+			serveConsole(w, r, proxy, url, role.access)
 		}
 	case "startbmc":
 		if cacheIndex != -1 {
 			// we must forward the request to the relevant test server
 			client := &http.Client{}
 			var req *http.Request
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/startbmc", nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/startbmc", nil)
 			_, _ = client.Do(req)
 			client = &http.Client{}
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/startbmcconsole", nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/startbmcconsole", nil)
 			_, _ = client.Do(req)
 		}
 	case "startsmbios":
@@ -613,7 +866,7 @@ func home(w http.ResponseWriter, r *http.Request) {
 			// we must forward the request to the relevant test server
 			client := &http.Client{}
 			var req *http.Request
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/startsmbios", nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/startsmbios", nil)
 			_, _ = client.Do(req)
 		}
 	case "js":
@@ -638,9 +891,9 @@ func home(w http.ResponseWriter, r *http.Request) {
 		if cacheIndex != -1 {
 			// We must forward the request
 			fmt.Printf("Forward bmcfirmware upload\n")
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort
+			r.URL.Host = "http://" + owned.ip + owned.tcpPort
 			_, tail = ShiftPath(r.URL.Path)
 			path := strings.Split(tail, "/")
 			r.URL.Path = "/bmcfirmware/" + path[2]
@@ -651,9 +904,9 @@ func home(w http.ResponseWriter, r *http.Request) {
 		if cacheIndex != -1 {
 			// We must forward the request
 			fmt.Printf("Forward biosfirmware upload\n")
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort)
+			url, _ := url.Parse("http://" + owned.ip + owned.tcpPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].ip + ciServers.servers[cacheIndex].tcpPort
+			r.URL.Host = "http://" + owned.ip + owned.tcpPort
 			_, tail = ShiftPath(r.URL.Path)
 			path := strings.Split(tail, "/")
 			r.URL.Path = "/biosfirmware/" + path[2]
@@ -671,8 +924,13 @@ func home(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			data := base.HTTPGetBody(r)
-			ciServers.servers[cacheIndex].gitToken = string(data)
-			fmt.Printf("Active token: %s\n", ciServers.servers[cacheIndex].gitToken)
+			withPool(func() {
+				if ciServers.servers[cacheIndex].currentOwner == cookie.Value {
+					ciServers.servers[cacheIndex].gitToken = string(data)
+					savePoolState()
+				}
+			})
+			fmt.Printf("Active token: %s\n", string(data))
 		}
 	case "buildbiosfirmware":
 		if cacheIndex != -1 {
@@ -688,11 +946,11 @@ func home(w http.ResponseWriter, r *http.Request) {
 			// which will start the compilation process and return
 			// the code to connect to the ttyd daemon
 			fmt.Printf("Forward biosfirmware build\n")
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].compileIP + compileTCPPort)
+			url, _ := url.Parse("http://" + owned.compileIP + compileTCPPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].compileIP + compileTCPPort
+			r.URL.Host = "http://" + owned.compileIP + compileTCPPort
 			// This approach is not really safe we shall transfer the Token through a specific call
-			r.URL.Path = tail + "/" + ciServers.servers[cacheIndex].gitToken
+			r.URL.Path = tail + "/" + owned.gitToken
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
 			proxy.ServeHTTP(w, r)
 		}
@@ -710,10 +968,10 @@ func home(w http.ResponseWriter, r *http.Request) {
 			// which will start the compilation process and return
 			// the code to connect to the ttyd daemon
 			fmt.Printf("Forward bmcfirmware build\n")
-			url, _ := url.Parse("http://" + ciServers.servers[cacheIndex].compileIP + compileTCPPort)
+			url, _ := url.Parse("http://" + owned.compileIP + compileTCPPort)
 			proxy := httputil.NewSingleHostReverseProxy(url)
-			r.URL.Host = "http://" + ciServers.servers[cacheIndex].compileIP + compileTCPPort
-			r.URL.Path = tail + "/" + ciServers.servers[cacheIndex].gitToken
+			r.URL.Host = "http://" + owned.compileIP + compileTCPPort
+			r.URL.Path = tail + "/" + owned.gitToken
 			r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
 			proxy.ServeHTTP(w, r)
 		}
@@ -726,7 +984,7 @@ func home(w http.ResponseWriter, r *http.Request) {
 			login := keys[2]
 			client := &http.Client{}
 			var req *http.Request
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/loadfromstoragesmbios/"+login, nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/loadfromstoragesmbios/"+login, nil)
 			_, _ = client.Do(req)
 		}
 	case "loadbuiltopenbmc":
@@ -738,7 +996,7 @@ func home(w http.ResponseWriter, r *http.Request) {
 			login := keys[2]
 			client := &http.Client{}
 			var req *http.Request
-			req, _ = http.NewRequest("GET", "http://"+ciServers.servers[cacheIndex].ip+ciServers.servers[cacheIndex].tcpPort+"/loadfromstoragebmc/"+login, nil)
+			req, _ = http.NewRequest("GET", "http://"+owned.ip+owned.tcpPort+"/loadfromstoragebmc/"+login, nil)
 			_, _ = client.Do(req)
 		}
 	case "":
@@ -756,7 +1014,7 @@ func home(w http.ResponseWriter, r *http.Request) {
 
 func bmcweb(w http.ResponseWriter, r *http.Request) {
 	// Let's print the session ID
-	cookie, err := r.Cookie("osfci_cookie")
+	cookie, err := sessionCookie(r)
 
 	// If the request is for a favicon.ico file we are just returning
 	// we do not offer such icon currently ;)
@@ -774,13 +1032,20 @@ func bmcweb(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		if cookie.Value != "" {
 			// We must get the IP address from the cache
-			for i := range ciServers.servers {
-				if ciServers.servers[i].currentOwner == cookie.Value {
-					if time.Now().Before(ciServers.servers[i].expiration) {
-						// We still own the server and we can go to the BMC
-						bmcIP = ciServers.servers[i].bmcIP
-					}
-				}
+			member := bmcMember(w, r)
+			index, owned, role := ownedServer(cookie.Value, member)
+			if index == -1 && member != "" {
+				// The remembered member may be the one of a previous group
+				index, owned, role = ownedServer(cookie.Value, "")
+			}
+			// Read only guests can only look at the BMC
+			if index != -1 && role.access == accessRead && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "403 Read only access", 403)
+				return
+			}
+			if index != -1 {
+				// We still own the server and we can go to the BMC
+				bmcIP = owned.bmcIP
 			}
 		} else {
 			if DNSDomain != "" {
@@ -856,63 +1121,32 @@ func main() {
 
 	// We must build our server pool for the moment
 	// This is define by the environment variable
-	// But this could be done by a registration mechanism later
-
-	var newFamily serverProduct
-	var family string
-	for i := 1; ; i++ {
-		family = fmt.Sprintf("family%d", i)
-		viperstring := "serverfamily." + family
-		if viper.IsSet(viperstring) {
-			brandstring := viperstring + ".Brand"
-			modelstring := viperstring + ".model"
-			activestring := viperstring + ".Active"
-			newFamily.Brand = viper.GetString(brandstring)
-			newFamily.Product = viper.GetString(modelstring)
-			newFamily.Active = viper.Get(activestring).(int)
-			ciServersProducts = append(ciServersProducts, newFamily)
-			continue
-		} else {
-			break
-		}
-	}
-
-	var newEntry serverEntry
-	var ctrl string
-	for i := 1; ; i++ {
-		ctrl = fmt.Sprintf("ctrl%d", i)
-		viperstring := "controller." + ctrl
-		if viper.IsSet(viperstring) {
-			serverstring := viperstring + ".servername"
-			bmcipstring := viperstring + ".SUTbmcIP"
-			compileripstring := viperstring + ".compilerIP"
-			ipstring := viperstring + ".ip"
-			tcpportstring := viperstring + ".tcpPort"
-			typetring := viperstring + ".SUTtype"
-			newEntry.servername = viper.GetString(serverstring)
-			newEntry.ip = viper.GetString(ipstring)
-			newEntry.tcpPort = viper.GetString(tcpportstring)
-			newEntry.compileIP = viper.GetString(compileripstring)
-			newEntry.currentOwner = ""
-			newEntry.gitToken = ""
-			newEntry.expiration = time.Now()
-			newEntry.bmcIP = viper.GetString(bmcipstring)
-			newEntry.queue = 0
-			servertype := viper.GetString(typetring)
-			fmt.Println("servertype=", servertype)
-			switch servertype {
-			case "DL360_Gen10":
-				newEntry.ProductIndex = 0
-			case "DL325_GEN10PLUS":
-				newEntry.ProductIndex = 1
-			}
-			ciServers.mux.Lock()
-			ciServers.servers = append(ciServers.servers, newEntry)
-			ciServers.mux.Unlock()
-			continue
-		} else {
-			break
-		}
+	// Controllers can also register themselves at runtime
+	// The pool is owned by a single goroutine
+
+	go poolOwner()
+	err = loadProducts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadControllers()
+
+	// The pool allocation survives gateway restarts
+	go restorePoolState()
+	go leaseReaper()
+	go healthChecker()
+	go benchProber()
+
+	if controllerTCPPort != "" && controllerSecret == "" {
+		fmt.Printf("CONTROLLER_SECRET is not set, controllers can't register\n")
+	} else if controllerTCPPort != "" {
+		// Controllers are reaching us on an internal port
+		controllerMux := http.NewServeMux()
+		controllerMux.HandleFunc("/controller/", controllerCallback)
+		go func() {
+			log.Fatal(http.ListenAndServe(controllerTCPPort, controllerMux))
+		}()
+		go controllersWatchdog()
 	}
 
 	if DNSDomain != "" {
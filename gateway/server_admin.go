@@ -0,0 +1,295 @@
+// OSFCI Server module - pool administration
+//
+// Signed requests of operators can list the pool, release a session, put
+// servers into maintenance and drain a whole product family. Admins also set
+// the priorities and the roles of the users.
+//   GET    /ci/admin/<login>/servers
+//   POST   /ci/admin/<login>/release/<servername>
+//   PUT    /ci/admin/<login>/maintenance/<servername>
+//   DELETE /ci/admin/<login>/maintenance/<servername>
+//   PUT    /ci/admin/<login>/drain/<model>
+//   DELETE /ci/admin/<login>/drain/<model>
+//   PUT    /ci/admin/<login>/priority/<nickname>
+//   PUT    /ci/admin/<login>/role/<nickname>
+//   GET    /ci/admin/<login>/audit[/<servername>]
+
+package main
+
+import (
+	"base/base"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminServer describes a server of the pool
+// Upercase is mandatory for JSON library parsing
+type adminServer struct {
+	Servername    string
+	Product       string
+	Labels        map[string]string
+	State         serverLifecycle
+	Owner         string
+	Group         string
+	Guests        []sessionGuest
+	Priority      string
+	Preempted     bool
+	Expiration    time.Time
+	RemainingTime string
+	Drain         bool
+	Retired       bool
+	Dynamic       bool
+	Quarantined   bool
+	ProbeError    string
+	BMCReachable  bool
+	Transitions   []serverTransition
+}
+
+// adminQueue lists the users waiting for a product
+// Upercase is mandatory for JSON library parsing
+type adminQueue struct {
+	Product string
+	Waiting []string
+}
+
+// adminPool is returned by the servers command
+// Upercase is mandatory for JSON library parsing
+type adminPool struct {
+	Servers []adminServer
+	Queues  []adminQueue
+}
+
+// poolStatus returns a copy of the pool, sessions are identified by their owner nickname
+// as the session cookies must never leave the gateway
+func poolStatus() adminPool {
+	var status adminPool
+	withPool(func() {
+		pruneTickets()
+		for _, entry := range ciServers.servers {
+			var server adminServer
+			server.Servername = entry.servername
+			server.Product = ciServersProducts[entry.ProductIndex].Product
+			server.Labels = entry.labels
+			server.State = entry.state
+			server.Drain = entry.drain
+			server.Retired = entry.retired
+			server.Dynamic = entry.dynamic
+			server.Quarantined = entry.quarantined
+			server.ProbeError = entry.probeError
+			server.BMCReachable = entry.bmcReachable
+			server.Transitions = append([]serverTransition(nil), entry.transitions...)
+			if entry.state == serverAllocated {
+				server.Owner = entry.ownerNickname
+				server.Group = entry.group
+				server.Guests = append([]sessionGuest(nil), entry.guests...)
+				server.Priority = entry.priority
+				server.Preempted = entry.preempted
+				server.Expiration = entry.expiration
+				server.RemainingTime = fmt.Sprintf("%d", entry.expiration.Unix()-time.Now().Unix())
+			}
+			status.Servers = append(status.Servers, server)
+		}
+		for product := range ciServersProducts {
+			var queue adminQueue
+			queue.Product = ciServersProducts[product].Product
+			for _, ticket := range waitQueues[product] {
+				queue.Waiting = append(queue.Waiting, ticket.Nickname)
+			}
+			status.Queues = append(status.Queues, queue)
+		}
+	})
+	return status
+}
+
+// releaseServer ends the lease of a server and of its group, the reaper cleans them up
+// must be called from the pool goroutine
+func releaseServer(index int) error {
+	entry := &ciServers.servers[index]
+	if entry.state != serverAllocated {
+		return fmt.Errorf("server %s is %s", entry.servername, entry.state)
+	}
+	endLease(index)
+	return nil
+}
+
+// startMaintenance takes a server out of service, an allocated server is
+// drained to keep its current lease
+// must be called from the pool goroutine
+func startMaintenance(index int, reason string) error {
+	entry := &ciServers.servers[index]
+	switch entry.state {
+	case serverMaintenance:
+		return nil
+	case serverAllocated, serverCleaning:
+		entry.drain = true
+		savePoolState()
+		return nil
+	}
+	return setServerState(index, serverMaintenance, reason)
+}
+
+// stopMaintenance puts a server back into service once cleaned up
+// must be called from the pool goroutine
+func stopMaintenance(index int, reason string) error {
+	entry := &ciServers.servers[index]
+	entry.drain = false
+	switch entry.state {
+	case serverMaintenance, serverFailed:
+		entry.cleanupFails = 0
+		entry.cleanupRetry = time.Now()
+		return setServerState(index, serverCleaning, reason)
+	}
+	savePoolState()
+	return nil
+}
+
+// adminCommand serves the pool administration requests
+// path is /admin/<login>/<command>/<servername or model>
+func adminCommand(w http.ResponseWriter, r *http.Request, tail string) {
+	keys := strings.Split(tail, "/")
+	if len(keys) < 4 {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	command := keys[1]
+	login := keys[2]
+	action := keys[3]
+	if !checkAccess(w, r, login, command+"/"+action) {
+		http.Error(w, "403 Access denied", 403)
+		return
+	}
+	target := ""
+	if len(keys) > 4 {
+		target = keys[4]
+	}
+	if action == "servers" && r.Method == http.MethodGet {
+		returnData, _ := json.Marshal(poolStatus())
+		w.Write(returnData)
+		return
+	}
+	if action == "audit" && r.Method == http.MethodGet {
+		var events []auditEvent
+		withPool(func() {
+			events = serverAudit(target, time.Time{})
+		})
+		returnData, _ := json.Marshal(events)
+		w.Write(returnData)
+		return
+	}
+	if target == "" {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	if action == "priority" && r.Method == http.MethodPut {
+		var update accountPriority
+		if json.Unmarshal(base.HTTPGetBody(r), &update) != nil {
+			http.Error(w, "401 Malformed request", 401)
+			return
+		}
+		for _, class := range []string{update.Priority, update.TokenPriority} {
+			if class != "" && priorityRank(class) == -1 {
+				http.Error(w, "401 Unknown priority class "+class, 401)
+				return
+			}
+		}
+		if err := setAccountPriority(target, update); err != nil {
+			http.Error(w, "404 "+err.Error(), 404)
+			return
+		}
+		fmt.Printf("Admin %s: priority of %s set to %q, API key %q\n", login, target, update.Priority, update.TokenPriority)
+		returnData, _ := json.Marshal(update)
+		w.Write(returnData)
+		return
+	}
+	if action == "role" && r.Method == http.MethodPut {
+		var update accountRole
+		if json.Unmarshal(base.HTTPGetBody(r), &update) != nil {
+			http.Error(w, "401 Malformed request", 401)
+			return
+		}
+		if update.Role == "" || base.RoleRank(update.Role) == -1 {
+			http.Error(w, "401 Unknown role "+update.Role, 401)
+			return
+		}
+		// There is always an admin left
+		if target == login {
+			http.Error(w, "409 Admins can't change their own role", 409)
+			return
+		}
+		if status, err := setAccountRole(target, update); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		fmt.Printf("Admin %s: role of %s set to %s\n", login, target, update.Role)
+		returnData, _ := json.Marshal(update)
+		w.Write(returnData)
+		return
+	}
+	reason := "requested by " + login
+	var err error
+	found := true
+	switch {
+	case action == "release" && r.Method == http.MethodPost:
+		withPool(func() {
+			index := findServer(target)
+			if index == -1 {
+				found = false
+				return
+			}
+			err = releaseServer(index)
+		})
+	case action == "maintenance" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		withPool(func() {
+			index := findServer(target)
+			if index == -1 {
+				found = false
+				return
+			}
+			if r.Method == http.MethodPut {
+				err = startMaintenance(index, reason)
+			} else {
+				err = stopMaintenance(index, reason)
+			}
+		})
+	case action == "drain" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		product := productIndex(target)
+		if product == -1 {
+			http.Error(w, "404 Unknown server model", 404)
+			return
+		}
+		withPool(func() {
+			for i := range ciServers.servers {
+				if ciServers.servers[i].ProductIndex != product {
+					continue
+				}
+				if r.Method == http.MethodPut {
+					err = startMaintenance(i, "family drained, "+reason)
+				} else {
+					err = stopMaintenance(i, "family back into service, "+reason)
+				}
+				if err != nil {
+					fmt.Printf("Can't drain %s: %s\n", ciServers.servers[i].servername, err)
+				}
+			}
+			err = nil
+		})
+	default:
+		http.Error(w, "401 Unknown admin command", 401)
+		return
+	}
+	if !found {
+		http.Error(w, "404 Unknown server", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "409 "+err.Error(), 409)
+		return
+	}
+	fmt.Printf("Admin %s: %s %s %s\n", login, r.Method, action, target)
+	// Released and maintained servers are cleaned up by the reaper
+	wakeReaper()
+	returnData, _ := json.Marshal(poolStatus())
+	w.Write(returnData)
+}
@@ -0,0 +1,336 @@
+// OSFCI Server module - session event stream
+//
+// Instead of polling getServer, bmcup and isRunning a client can open
+//   GET /ci/events
+// which is a Server-Sent Events stream following the session of its cookie.
+// An event is sent each time something changes:
+//   queue       position into the wait queue, estimated wait and held server
+//   allocation  server leased to or shared with the session, empty once over
+//   lease       remaining lease time, sent again every minute
+//   bmc         the BMC of the server became reachable or unreachable
+//   build       a firmware build started or stopped on the compile node
+// A ticket is kept into its queue as long as its stream is open. A client
+// seeing a held server claims it with getServer. Browsers reconnect by
+// themselves when the stream is cut.
+// A single prober checks the BMC and the compile node of the servers which
+// are followed, the streams of a server share its results. The write timeout
+// of the gateway doesn't apply to the streams, each write has its own.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventsInterval is the time between two scans of a session
+var eventsInterval = 5 * time.Second
+
+// eventsPing is the longest silence on a stream, proxies drop idle connections
+var eventsPing = 30 * time.Second
+
+// eventsWriteTimeout bounds each write to a stream
+var eventsWriteTimeout = 30 * time.Second
+
+// buildFirmwares are the builds the compile node reports through isRunning
+var buildFirmwares = []string{"openbmc", "linuxboot"}
+
+// benchProbe is what the prober last saw of the bench of a server
+type benchProbe struct {
+	bmcIP     string
+	compileIP string
+	watched   time.Time
+	probed    bool
+	bmcUp     bool
+	builds    map[string]string
+}
+
+// benchProbes are the probes of the followed servers by servername
+var benchProbes = make(map[string]*benchProbe)
+var benchProbesLock sync.Mutex
+
+// benchWakeup asks the prober to probe a newly followed server at once
+var benchWakeup = make(chan struct{}, 1)
+
+// queueStatus is the place of a session into a wait queue
+// Upercase is mandatory for JSON library parsing
+type queueStatus struct {
+	Product     string
+	Queue       string
+	Waittime    string
+	Ticket      string
+	Held        bool
+	ClaimBefore string
+}
+
+// allocationStatus is the server a session is running on
+// Upercase is mandatory for JSON library parsing
+type allocationStatus struct {
+	Servername    string
+	Product       string
+	Group         string
+	Access        sessionAccess
+	RemainingTime string
+}
+
+// sessionStatus is what a stream reports about a session
+type sessionStatus struct {
+	queue      queueStatus
+	allocation allocationStatus
+	expiration time.Time
+	bmcIP      string
+	compileIP  string
+}
+
+// eventStream writes the events of a session, an event is only sent when its key changed
+type eventStream struct {
+	w         http.ResponseWriter
+	flusher   http.Flusher
+	keys      map[string]string
+	lastWrite time.Time
+}
+
+// write sends a piece of the stream within its own deadline
+func (stream *eventStream) write(format string, args ...interface{}) {
+	http.NewResponseController(stream.w).SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+	fmt.Fprintf(stream.w, format, args...)
+	stream.flusher.Flush()
+	stream.lastWrite = time.Now()
+}
+
+// send writes an event if its key is not the one sent last time
+func (stream *eventStream) send(event string, key string, data interface{}) {
+	if last, ok := stream.keys[event]; ok && last == key {
+		return
+	}
+	stream.keys[event] = key
+	content, _ := json.Marshal(data)
+	stream.write("event: %s\ndata: %s\n\n", event, content)
+}
+
+// ping keeps an idle stream open
+func (stream *eventStream) ping() {
+	if time.Since(stream.lastWrite) < eventsPing {
+		return
+	}
+	stream.write(": ping\n\n")
+}
+
+// bmcReachable tells if the BMC web interface answers
+func bmcReachable(bmcIP string) bool {
+	if bmcIP == "" {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", bmcIP+":443", 220*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// buildRunning asks the compile node if a firmware build is running, the
+// answer is the status isRunning returns
+func buildRunning(compileIP string, firmware string) string {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + compileIP + compileTCPPort + "/isRunning/" + firmware)
+	if err != nil {
+		return "unknown"
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		Status string `json:"status"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&answer) != nil {
+		return "unknown"
+	}
+	return answer.Status
+}
+
+// watchBench returns the last probe of the bench of a server and keeps it
+// probed, the probe is empty until the prober reached the bench once
+func watchBench(servername string, bmcIP string, compileIP string) benchProbe {
+	benchProbesLock.Lock()
+	defer benchProbesLock.Unlock()
+	probe, ok := benchProbes[servername]
+	if !ok || probe.bmcIP != bmcIP || probe.compileIP != compileIP {
+		probe = &benchProbe{bmcIP: bmcIP, compileIP: compileIP}
+		benchProbes[servername] = probe
+		select {
+		case benchWakeup <- struct{}{}:
+		default:
+		}
+	}
+	probe.watched = time.Now()
+	return *probe
+}
+
+// benchProber probes the benches of the followed servers, a server is
+// forgotten once no stream follows it
+func benchProber() {
+	for {
+		select {
+		case <-benchWakeup:
+		case <-time.After(eventsInterval):
+		}
+		benchProbesLock.Lock()
+		probes := make(map[string]benchProbe)
+		for servername, probe := range benchProbes {
+			if time.Since(probe.watched) > 3*eventsInterval {
+				delete(benchProbes, servername)
+				continue
+			}
+			probes[servername] = *probe
+		}
+		benchProbesLock.Unlock()
+		var probing sync.WaitGroup
+		for servername, probe := range probes {
+			probing.Add(1)
+			go func(servername string, probe benchProbe) {
+				defer probing.Done()
+				probe.bmcUp = bmcReachable(probe.bmcIP)
+				if probe.compileIP != "" {
+					probe.builds = make(map[string]string)
+					for _, firmware := range buildFirmwares {
+						probe.builds[firmware] = buildRunning(probe.compileIP, firmware)
+					}
+				}
+				probe.probed = true
+				benchProbesLock.Lock()
+				// The server may have moved while it was probed
+				if current, ok := benchProbes[servername]; ok && current.bmcIP == probe.bmcIP && current.compileIP == probe.compileIP {
+					current.probed = true
+					current.bmcUp = probe.bmcUp
+					current.builds = probe.builds
+				}
+				benchProbesLock.Unlock()
+			}(servername, probe)
+		}
+		probing.Wait()
+	}
+}
+
+// readSession returns the queue ticket and the server of a session, the
+// ticket is kept alive as the stream replaces the polling
+func readSession(cookie string) sessionStatus {
+	var status sessionStatus
+	withPool(func() {
+		claimRestored(cookie)
+		pruneTickets()
+		pruneReservations()
+		for product := range waitQueues {
+			fairShareOrder(product)
+			position := findTicket(product, cookie, "")
+			if position == -1 {
+				continue
+			}
+			ticket := waitQueues[product][position]
+			// Watching a held server is not claiming it
+			if !ticketHeld(ticket) {
+				ticket.LastSeen = time.Now()
+			}
+			constraints, _ := parseSelector(ticket.Selector)
+			free := matchingServers(freeServers(product), constraints)
+			available := len(free) - reservedServers(product, time.Now(), time.Now().Add(leaseLength(product)))
+			if available < 0 {
+				available = 0
+			}
+			wait := estimateWait(product, position, available)
+			if cooldown := cooldownLeft(ticket.Nickname); cooldown > wait {
+				wait = cooldown
+			}
+			status.queue = queueStatus{
+				Product:  ticket.Model,
+				Queue:    fmt.Sprintf("%d", position),
+				Waittime: fmt.Sprintf("%.0f", wait.Seconds()),
+				Ticket:   ticket.ID,
+				Held:     ticketHeld(ticket),
+			}
+			if ticketHeld(ticket) {
+				status.queue.Waittime = "0"
+				status.queue.ClaimBefore = ticket.HeldUntil.Format(time.RFC1123Z)
+			}
+			return
+		}
+	})
+	index, entry, role := ownedServer(cookie, "")
+	if index != -1 {
+		status.allocation = allocationStatus{
+			Servername: entry.servername,
+			Product:    ciServersProducts[entry.ProductIndex].Product,
+			Group:      entry.group,
+			Access:     role.access,
+		}
+		status.expiration = entry.expiration
+		status.bmcIP = entry.bmcIP
+		status.compileIP = entry.compileIP
+	}
+	return status
+}
+
+// eventsCommand streams the events of the session of a cookie up to the client leaves
+func eventsCommand(w http.ResponseWriter, r *http.Request, cookie string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 Streaming unsupported", 500)
+		return
+	}
+	if cookieOwner(cookie) == "" {
+		http.Error(w, "401 Unknown session, please log in again", 401)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	stream := &eventStream{w: w, flusher: flusher, keys: make(map[string]string)}
+	stream.write("retry: %d\n\n", eventsInterval/time.Millisecond)
+	for {
+		status := readSession(cookie)
+		queue := status.queue
+		stream.send("queue", fmt.Sprintf("%s/%s/%s/%t", queue.Ticket, queue.Product, queue.Queue, queue.Held), queue)
+		allocation := status.allocation
+		remaining := int64(0)
+		if allocation.Servername != "" {
+			remaining = status.expiration.Unix() - time.Now().Unix()
+			if remaining < 0 {
+				remaining = 0
+			}
+		}
+		allocation.RemainingTime = fmt.Sprintf("%d", remaining)
+		stream.send("allocation", fmt.Sprintf("%s/%s/%s", allocation.Servername, allocation.Group, allocation.Access), allocation)
+		if allocation.Servername != "" {
+			// The lease is sent when it is extended and every minute
+			stream.send("lease", fmt.Sprintf("%s/%d/%d", allocation.Servername, status.expiration.Unix(), remaining/60),
+				map[string]string{"Servername": allocation.Servername, "RemainingTime": allocation.RemainingTime})
+			probe := watchBench(allocation.Servername, status.bmcIP, status.compileIP)
+			if probe.probed {
+				up := "0"
+				if probe.bmcUp {
+					up = "1"
+				}
+				stream.send("bmc", allocation.Servername+"/"+up, map[string]string{"Servername": allocation.Servername, "Up": up})
+			}
+			if probe.probed && status.compileIP != "" {
+				key := allocation.Servername
+				for _, firmware := range buildFirmwares {
+					key = key + "/" + probe.builds[firmware]
+				}
+				stream.send("build", key, map[string]interface{}{"Servername": allocation.Servername, "Builds": probe.builds})
+			}
+		}
+		stream.ping()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(eventsInterval):
+		}
+		// The stream ends with its session
+		if cookieOwner(cookie) == "" {
+			return
+		}
+	}
+}
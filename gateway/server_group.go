@@ -0,0 +1,310 @@
+// OSFCI Server module - multi-server allocation
+//
+// Cluster tests need several SUTs at once. A group request gets all the
+// servers it asks for or none of them:
+//   /ci/getServers/<model>[:count][,<model>[:count]...]?selector=<labels>
+// The servers of a group share one lease, they are extended together and
+// released together by stopServer. A group request is not queued, the users
+// already waiting keep their precedence and the client has to poll again.
+// The session commands, the console and the BMC pages reach the member named
+// by ?server=<servername>, the first one of the group without it. The BMC
+// pages keep going to the member of their first request.
+
+package main
+
+import (
+	"base/base"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxGroupServers is the largest number of servers a group can get
+var maxGroupServers = 8
+
+// groupRequest is a number of servers of a product
+type groupRequest struct {
+	product int
+	count   int
+}
+
+// parseGroupRequest reads a list of <model>[:count]
+func parseGroupRequest(spec string) ([]groupRequest, error) {
+	var requests []groupRequest
+	total := 0
+	for _, term := range strings.Split(spec, ",") {
+		if term == "" {
+			continue
+		}
+		pair := strings.SplitN(term, ":", 2)
+		product := productIndex(pair[0])
+		if product == -1 {
+			return nil, fmt.Errorf("unknown server model %s", pair[0])
+		}
+		count := 1
+		if len(pair) == 2 {
+			var err error
+			count, err = strconv.Atoi(pair[1])
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("bad server count %q", pair[1])
+			}
+		}
+		total += count
+		merged := false
+		for i := range requests {
+			if requests[i].product == product {
+				requests[i].count += count
+				merged = true
+			}
+		}
+		if !merged {
+			requests = append(requests, groupRequest{product, count})
+		}
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no server requested")
+	}
+	if total > maxGroupServers {
+		return nil, fmt.Errorf("at most %d servers can be allocated together", maxGroupServers)
+	}
+	return requests, nil
+}
+
+// bmcMemberCookie remembers the member of a group the BMC pages go to
+const bmcMemberCookie = "osfci_server"
+
+// bmcMember returns the member of a group a BMC page request goes to
+func bmcMember(w http.ResponseWriter, r *http.Request) string {
+	if servername := r.URL.Query().Get("server"); servername != "" {
+		http.SetCookie(w, &http.Cookie{Name: bmcMemberCookie, Value: servername, Path: "/", HttpOnly: true, Secure: true})
+		return servername
+	}
+	if cookie, err := r.Cookie(bmcMemberCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// groupMembers returns the servers sharing a group lease
+// must be called from the pool goroutine
+func groupMembers(group string) []int {
+	var members []int
+	for i := range ciServers.servers {
+		if ciServers.servers[i].group == group && ciServers.servers[i].state == serverAllocated {
+			members = append(members, i)
+		}
+	}
+	return members
+}
+
+// leaseMembers returns a server and the other servers of its group
+// must be called from the pool goroutine
+func leaseMembers(index int) []int {
+	if ciServers.servers[index].group == "" {
+		return []int{index}
+	}
+	return groupMembers(ciServers.servers[index].group)
+}
+
+// endLease ends the lease of a server and of its group, the reaper cleans them up
+// must be called from the pool goroutine
+func endLease(index int) {
+	for _, i := range leaseMembers(index) {
+		ciServers.servers[i].expiration = time.Now()
+	}
+	savePoolState()
+}
+
+// ownedGroup returns the servers of the group leased to a session cookie
+// must be called from the pool goroutine
+func ownedGroup(cookie string) []int {
+	for i := range ciServers.servers {
+		entry := ciServers.servers[i]
+		if entry.state == serverAllocated && entry.currentOwner == cookie && entry.group != "" &&
+			time.Now().Before(entry.expiration) {
+			return groupMembers(entry.group)
+		}
+	}
+	return nil
+}
+
+// groupCommand allocates a group of servers to the caller
+// path is /<model>[:count][,<model>[:count]...]
+func groupCommand(w http.ResponseWriter, r *http.Request, tail string, cookie string) {
+	spec, _ := ShiftPath(tail)
+	requests, err := parseGroupRequest(spec)
+	if err != nil {
+		http.Error(w, "400 Malformed request, "+err.Error(), 400)
+		return
+	}
+	constraints, err := parseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, "400 Malformed selector, "+err.Error(), 400)
+		return
+	}
+	nickname := cookieOwner(cookie)
+	if nickname == "" {
+		http.Error(w, "401 Unknown session, please log in again", 401)
+		return
+	}
+	priority := requestPriority(r, cookie, nickname)
+	total := 0
+	for _, request := range requests {
+		total += request.count
+	}
+
+	// Upercase is mandatory for JSON library parsing
+	type groupMember struct {
+		Servername string
+		Product    string
+	}
+	type returnValue struct {
+		Group         string
+		Servers       []groupMember
+		Waittime      string
+		RemainingTime string
+		Missing       string
+	}
+	var myoutput returnValue
+	var allocated []serverEntry
+	newLease := false
+	var quotaErr error
+	var selectorErr error
+	withPool(func() {
+		// A client polling again gets back its group
+		if members := ownedGroup(cookie); len(members) > 0 {
+			for _, i := range members {
+				allocated = append(allocated, ciServers.servers[i])
+			}
+			return
+		}
+		pruneTickets()
+		pruneReservations()
+		pruneUsages()
+		quotaErr = quotaCheck(nickname)
+		if quotaErr == nil && quotaMaxServers > 0 && heldServers(nickname)+total > quotaMaxServers {
+			quotaErr = fmt.Errorf("you can hold at most %d servers", quotaMaxServers)
+		}
+		if quotaErr != nil {
+			return
+		}
+		// The shared lease is the shortest one of the products
+		var length time.Duration
+		for _, request := range requests {
+			if length == 0 || leaseLength(request.product) < length {
+				length = leaseLength(request.product)
+			}
+		}
+		if left := quotaTimeLeft(nickname); left >= 0 && left/time.Duration(total) < length {
+			length = left / time.Duration(total)
+		}
+		leaseEnd := time.Now().Add(length)
+		var wait time.Duration
+		var missing []string
+		var chosen []int
+		for _, request := range requests {
+			selectorErr = unsatisfiableSelector(request.product, constraints)
+			if selectorErr != nil {
+				return
+			}
+			model := ciServersProducts[request.product].Product
+			inService := 0
+			for i := range ciServers.servers {
+				entry := ciServers.servers[i]
+				if entry.ProductIndex == request.product && !entry.retired && !entry.quarantined &&
+					entry.state != serverMaintenance && entry.state != serverFailed &&
+					matchSelector(entry.labels, constraints) {
+					inService++
+				}
+			}
+			if inService < request.count {
+				selectorErr = fmt.Errorf("only %d %s servers in service match, %d requested", inService, model, request.count)
+				return
+			}
+			// Users already waiting for that product go first
+			free := matchingServers(freeServers(request.product), constraints)
+			position := findTicket(request.product, cookie, "")
+			if position == -1 {
+				position = len(waitQueues[request.product])
+			}
+			ahead := ticketsAhead(request.product, position, free)
+			available := len(free) - reservedServers(request.product, time.Now(), leaseEnd) - ahead
+			if available < request.count {
+				if available < 0 {
+					available = 0
+				}
+				missing = append(missing, fmt.Sprintf("%d %s", request.count-available, model))
+				estimate := estimateWait(request.product, ahead+request.count-1, len(free))
+				if estimate > wait {
+					wait = estimate
+				}
+				continue
+			}
+			chosen = append(chosen, free[:request.count]...)
+		}
+		if cooldown := cooldownLeft(nickname); cooldown > 0 {
+			missing = append(missing, "cooldown")
+			if cooldown > wait {
+				wait = cooldown
+			}
+		}
+		if len(missing) > 0 {
+			myoutput.Waittime = fmt.Sprintf("%.0f", wait.Seconds())
+			myoutput.Missing = strings.Join(missing, ", ")
+			return
+		}
+		group := base.GenerateAccountACKLink(16)
+		for _, i := range chosen {
+			ciServers.servers[i].expiration = leaseEnd
+			ciServers.servers[i].leaseStart = time.Now()
+			ciServers.servers[i].extensions = 0
+			ciServers.servers[i].currentOwner = cookie
+			ciServers.servers[i].ownerNickname = nickname
+			ciServers.servers[i].priority = priority
+			ciServers.servers[i].preempted = false
+			ciServers.servers[i].group = group
+			startUsage(nickname, ciServers.servers[i].servername, leaseEnd)
+			setServerState(i, serverAllocated, "leased to "+nickname+" in group "+group)
+			allocated = append(allocated, ciServers.servers[i])
+		}
+		newLease = true
+	})
+	if quotaErr != nil {
+		http.Error(w, "429 "+quotaErr.Error(), 429)
+		return
+	}
+	if selectorErr != nil {
+		http.Error(w, "503 "+selectorErr.Error(), 503)
+		return
+	}
+	if len(allocated) > 0 {
+		sort.Slice(allocated, func(i, j int) bool { return allocated[i].servername < allocated[j].servername })
+		myoutput.Group = allocated[0].group
+		myoutput.Waittime = "0"
+		myoutput.RemainingTime = fmt.Sprintf("%d", allocated[0].expiration.Unix()-time.Now().Unix())
+		for _, entry := range allocated {
+			myoutput.Servers = append(myoutput.Servers, groupMember{entry.servername, ciServersProducts[entry.ProductIndex].Product})
+		}
+	} else {
+		myoutput.RemainingTime = fmt.Sprintf("%d", 0)
+	}
+	if newLease {
+		// The servers are turned off as to be cleaned
+		var wg sync.WaitGroup
+		for _, entry := range allocated {
+			wg.Add(1)
+			go func(entry serverEntry) {
+				defer wg.Done()
+				resetServer(entry)
+			}(entry)
+		}
+		wg.Wait()
+	}
+	returnData, _ := json.Marshal(myoutput)
+	w.Write(returnData)
+}
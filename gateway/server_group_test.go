@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPool runs the pool goroutine once for the tests using withPool
+var testPool sync.Once
+
+func TestParseGroupRequest(t *testing.T) {
+	ciServersProducts = []serverProduct{{Product: "dl360"}, {Product: "dl380"}}
+	maxGroupServers = 8
+	tests := []struct {
+		name string
+		spec string
+		want []groupRequest
+		fail bool
+	}{
+		{"one server", "dl360", []groupRequest{{0, 1}}, false},
+		{"count", "dl380:3", []groupRequest{{1, 3}}, false},
+		{"two models", "dl360:2,dl380", []groupRequest{{0, 2}, {1, 1}}, false},
+		{"same model merged", "dl360,dl380:2,dl360:3", []groupRequest{{0, 4}, {1, 2}}, false},
+		{"empty terms skipped", ",dl360,,dl380,", []groupRequest{{0, 1}, {1, 1}}, false},
+		{"maximum", "dl360:5,dl380:3", []groupRequest{{0, 5}, {1, 3}}, false},
+		{"above the maximum", "dl360:5,dl380:4", nil, true},
+		{"merged above the maximum", "dl360:8,dl360", nil, true},
+		{"empty", "", nil, true},
+		{"only empty terms", ",,", nil, true},
+		{"unknown model", "dl360,dl999", nil, true},
+		{"zero count", "dl360:0", nil, true},
+		{"negative count", "dl360:-1", nil, true},
+		{"count not a number", "dl360:two", nil, true},
+		{"empty count", "dl360:", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseGroupRequest(test.spec)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: parseGroupRequest(%q) = %v, want an error", test.name, test.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseGroupRequest(%q) failed: %s", test.name, test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseGroupRequest(%q) = %v, want %v", test.name, test.spec, got, test.want)
+		}
+	}
+}
+
+func TestOwnedServerGroupMember(t *testing.T) {
+	testPool.Do(func() { go poolOwner() })
+	lease := time.Now().Add(time.Hour)
+	withPool(func() {
+		ciServers.servers = []serverEntry{
+			{servername: "srv1", state: serverAllocated, currentOwner: "cookie", group: "g1", expiration: lease},
+			{servername: "srv2", state: serverAllocated, currentOwner: "cookie", group: "g1", expiration: lease},
+			{servername: "srv3", state: serverAllocated, currentOwner: "other", expiration: lease},
+		}
+	})
+	tests := []struct {
+		name       string
+		servername string
+		want       int
+	}{
+		{"first member", "", 0},
+		{"named member", "srv1", 0},
+		{"other member", "srv2", 1},
+		{"server of another session", "srv3", -1},
+		{"unknown server", "srv9", -1},
+	}
+	for _, test := range tests {
+		if index, _, _ := ownedServer("cookie", test.servername); index != test.want {
+			t.Errorf("%s: ownedServer(%q) = %d, want %d", test.name, test.servername, index, test.want)
+		}
+	}
+	withPool(func() { ciServers.servers = nil })
+}
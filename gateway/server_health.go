@@ -0,0 +1,153 @@
+// OSFCI Server module - health probes
+//
+// The gateway regularly connects to the controller, the compile node and
+// the BMC of each server. A server failing its probes a few times in a row
+// is quarantined: it is not handed to users anymore up to the time its
+// probes succeed again.
+
+package main
+
+import (
+	"base/base"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// healthInterval is the time between two probes of a server
+var healthInterval = 30 * time.Second
+
+// healthFailures is the number of failed probes in a row quarantining a server
+var healthFailures = 3
+
+// healthProbeBMC makes the BMC probe mandatory, the BMC of a SUT running
+// from an em100 is only up while a user powers it so this is off by default
+var healthProbeBMC bool
+
+// operatorEmail receives the outage reports
+var operatorEmail string
+
+// probeTimeout is the longest time a probe can take
+var probeTimeout = 3 * time.Second
+
+// serverProbe is the result of the probes of a server
+type serverProbe struct {
+	servername   string
+	err          error
+	bmcReachable bool
+}
+
+// probeTCP checks that something is listening at address
+func probeTCP(address string) error {
+	conn, err := net.DialTimeout("tcp", address, probeTimeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// probeServer checks that the controller, the compile node and the BMC of a server answer
+func probeServer(entry serverEntry) serverProbe {
+	var probe serverProbe
+	probe.servername = entry.servername
+	if entry.bmcIP != "" {
+		probe.bmcReachable = probeTCP(entry.bmcIP+":443") == nil
+	}
+	err := probeTCP(entry.ip + entry.tcpPort)
+	if err != nil {
+		probe.err = fmt.Errorf("controller is unreachable: %s", err)
+		return probe
+	}
+	if entry.compileIP != "" {
+		err = probeTCP(entry.compileIP + compileTCPPort)
+		if err != nil {
+			probe.err = fmt.Errorf("compile node is unreachable: %s", err)
+			return probe
+		}
+	}
+	if healthProbeBMC && entry.bmcIP != "" && !probe.bmcReachable {
+		probe.err = fmt.Errorf("BMC %s is unreachable", entry.bmcIP)
+	}
+	return probe
+}
+
+// reportOutage logs a change of health of a server and sends it to the operator
+func reportOutage(servername string, subject string, message string) {
+	fmt.Printf("Server %s: %s\n", servername, message)
+	if operatorEmail != "" {
+		go base.SendEmail(operatorEmail, "OSFCI "+servername+" "+subject, message)
+	}
+}
+
+// applyProbe updates the health of a server from its last probe
+// must be called from the pool goroutine
+func applyProbe(probe serverProbe) {
+	index := findServer(probe.servername)
+	if index == -1 {
+		return
+	}
+	entry := &ciServers.servers[index]
+	entry.lastProbe = time.Now()
+	entry.bmcReachable = probe.bmcReachable
+	if probe.err != nil {
+		entry.probeFailures++
+		entry.probeError = probe.err.Error()
+		if entry.probeFailures >= healthFailures && !entry.quarantined {
+			entry.quarantined = true
+			reportOutage(entry.servername, "is quarantined",
+				fmt.Sprintf("quarantined after %d failed probes, %s", entry.probeFailures, entry.probeError))
+		}
+		return
+	}
+	entry.probeFailures = 0
+	entry.probeError = ""
+	if !entry.quarantined {
+		return
+	}
+	entry.quarantined = false
+	reportOutage(entry.servername, "is back", "probes succeed again, back into the pool")
+	// Its cleanup most probably failed while it was unreachable
+	switch entry.state {
+	case serverFailed:
+		entry.cleanupFails = 0
+		entry.cleanupRetry = time.Now()
+		setServerState(index, serverCleaning, "health probes recovered")
+		wakeReaper()
+	case serverCleaning:
+		entry.cleanupRetry = time.Now()
+		wakeReaper()
+	}
+}
+
+// healthChecker probes all the servers of the pool
+func healthChecker() {
+	for {
+		var entries []serverEntry
+		withPool(func() {
+			for i := range ciServers.servers {
+				if !ciServers.servers[i].retired {
+					entries = append(entries, ciServers.servers[i])
+				}
+			}
+		})
+		// A server which doesn't answer must not delay the other ones
+		probes := make([]serverProbe, len(entries))
+		var wg sync.WaitGroup
+		for i := range entries {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				probes[i] = probeServer(entries[i])
+			}(i)
+		}
+		wg.Wait()
+		withPool(func() {
+			for _, probe := range probes {
+				applyProbe(probe)
+			}
+		})
+		time.Sleep(healthInterval)
+	}
+}
@@ -0,0 +1,235 @@
+// OSFCI Server module - server labels
+//
+// Controllers carry free form labels like cpu=epyc or emulators=yes, set in
+// their configuration entry or sent when they register. A getServer request
+// can add a selector to its product, for example
+//   /ci/getServer/<model>?selector=cpu=epyc,emulators=yes
+// A constraint is key=value, key!=value, key in (value,value...) or key
+// alone which requires the label to be set. Only the servers matching all
+// the constraints are allocated to the request.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// labelConstraint is one term of a selector
+type labelConstraint struct {
+	key    string
+	value  string
+	negate bool
+	// values are the accepted values of an in constraint
+	values []string
+}
+
+// String returns the constraint as it is written into a selector
+func (constraint labelConstraint) String() string {
+	if len(constraint.values) > 0 {
+		return constraint.key + " in (" + strings.Join(constraint.values, ",") + ")"
+	}
+	if constraint.value == "" && !constraint.negate {
+		return constraint.key
+	}
+	if constraint.negate {
+		return constraint.key + "!=" + constraint.value
+	}
+	return constraint.key + "=" + constraint.value
+}
+
+// matches tells if a set of labels satisfies the constraint
+func (constraint labelConstraint) matches(labels map[string]string) bool {
+	value, ok := labels[constraint.key]
+	if len(constraint.values) > 0 {
+		for _, accepted := range constraint.values {
+			if ok && strings.EqualFold(value, accepted) {
+				return true
+			}
+		}
+		return false
+	}
+	if constraint.value == "" && !constraint.negate {
+		return ok
+	}
+	equal := ok && strings.EqualFold(value, constraint.value)
+	return equal != constraint.negate
+}
+
+// normalizeLabels lowercases the keys of labels coming from a configuration
+func normalizeLabels(labels map[string]string) map[string]string {
+	normalized := make(map[string]string)
+	for key, value := range labels {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key != "" {
+			normalized[key] = value
+		}
+	}
+	return normalized
+}
+
+// splitSelector cuts a selector at the commas which are not within the
+// values of an in constraint
+func splitSelector(selector string) ([]string, error) {
+	var terms []string
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+		if depth < 0 || depth > 1 {
+			return nil, fmt.Errorf("parentheses of %q are unbalanced", selector)
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("parentheses of %q are unbalanced", selector)
+	}
+	return append(terms, selector[start:]), nil
+}
+
+// parseInConstraint reads a key in (value,value...) term
+func parseInConstraint(term string) (labelConstraint, error) {
+	var constraint labelConstraint
+	open := strings.Index(term, "(")
+	words := strings.Fields(term[:open])
+	if len(words) != 2 || words[1] != "in" || !strings.HasSuffix(term, ")") {
+		return constraint, fmt.Errorf("constraint %q is malformed", term)
+	}
+	constraint.key = strings.ToLower(words[0])
+	for _, value := range strings.Split(term[open+1:len(term)-1], ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return constraint, fmt.Errorf("constraint %q has an empty value", term)
+		}
+		constraint.values = append(constraint.values, value)
+	}
+	return constraint, nil
+}
+
+// parseSelector reads the constraints of a getServer selector
+func parseSelector(selector string) ([]labelConstraint, error) {
+	var constraints []labelConstraint
+	terms, err := splitSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		if strings.Contains(term, "(") {
+			constraint, err := parseInConstraint(term)
+			if err != nil {
+				return nil, err
+			}
+			constraints = append(constraints, constraint)
+			continue
+		}
+		var constraint labelConstraint
+		if pair := strings.SplitN(term, "!=", 2); len(pair) == 2 {
+			constraint = labelConstraint{key: pair[0], value: pair[1], negate: true}
+		} else if pair := strings.SplitN(term, "=", 2); len(pair) == 2 {
+			constraint = labelConstraint{key: pair[0], value: pair[1]}
+		} else {
+			constraint = labelConstraint{key: term}
+		}
+		constraint.key = strings.ToLower(strings.TrimSpace(constraint.key))
+		constraint.value = strings.TrimSpace(constraint.value)
+		if constraint.key == "" || (constraint.negate && constraint.value == "") {
+			return nil, fmt.Errorf("constraint %q is malformed", term)
+		}
+		if !constraint.negate && strings.Contains(term, "=") && constraint.value == "" {
+			return nil, fmt.Errorf("constraint %q has no value", term)
+		}
+		constraints = append(constraints, constraint)
+	}
+	return constraints, nil
+}
+
+// matchSelector tells if a set of labels satisfies all the constraints
+func matchSelector(labels map[string]string, constraints []labelConstraint) bool {
+	for _, constraint := range constraints {
+		if !constraint.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchingServers keeps the servers satisfying the constraints
+// must be called from the pool goroutine
+func matchingServers(indexes []int, constraints []labelConstraint) []int {
+	var matching []int
+	for _, i := range indexes {
+		if matchSelector(ciServers.servers[i].labels, constraints) {
+			matching = append(matching, i)
+		}
+	}
+	return matching
+}
+
+// ticketsAhead returns the number of tickets before position which could be
+// served by one of the free servers, the other ones don't delay us
+// must be called from the pool goroutine
+func ticketsAhead(product int, position int, free []int) int {
+	ahead := 0
+	for i, ticket := range waitQueues[product] {
+		if i >= position {
+			break
+		}
+		constraints, _ := parseSelector(ticket.Selector)
+		if len(matchingServers(free, constraints)) > 0 {
+			ahead++
+		}
+	}
+	return ahead
+}
+
+// unsatisfiableSelector returns which constraint no server of the product in
+// service satisfies once the previous constraints are applied
+// must be called from the pool goroutine
+func unsatisfiableSelector(product int, constraints []labelConstraint) error {
+	var candidates []int
+	for i := range ciServers.servers {
+		entry := ciServers.servers[i]
+		if entry.ProductIndex != product || entry.retired || entry.state == serverMaintenance || entry.state == serverFailed {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	for _, constraint := range constraints {
+		matching := matchingServers(candidates, []labelConstraint{constraint})
+		if len(matching) == 0 {
+			// Tell the user what could have been asked instead
+			values := make(map[string]bool)
+			for _, i := range candidates {
+				if value, ok := ciServers.servers[i].labels[constraint.key]; ok {
+					values[value] = true
+				}
+			}
+			var known []string
+			for value := range values {
+				known = append(known, value)
+			}
+			sort.Strings(known)
+			model := ciServersProducts[product].Product
+			if len(known) == 0 {
+				return fmt.Errorf("no %s server in service satisfies %s, no server has a %s label", model, constraint, constraint.key)
+			}
+			return fmt.Errorf("no %s server in service satisfies %s, %s is one of %s", model, constraint, constraint.key, strings.Join(known, ", "))
+		}
+		candidates = matching
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		want     []labelConstraint
+		fail     bool
+	}{
+		{"empty", "", nil, false},
+		{"only empty terms", " , ,", nil, false},
+		{"equal", "cpu=epyc", []labelConstraint{{key: "cpu", value: "epyc"}}, false},
+		{"not equal", "cpu!=xeon", []labelConstraint{{key: "cpu", value: "xeon", negate: true}}, false},
+		{"key alone", "emulators", []labelConstraint{{key: "emulators"}}, false},
+		{"key lowercased and spaces trimmed", " CPU = epyc ", []labelConstraint{{key: "cpu", value: "epyc"}}, false},
+		{"in", "cpu in (epyc, xeon)", []labelConstraint{{key: "cpu", values: []string{"epyc", "xeon"}}}, false},
+		{"in with other terms", "bmc=openbmc,cpu in (epyc,xeon),usb", []labelConstraint{
+			{key: "bmc", value: "openbmc"},
+			{key: "cpu", values: []string{"epyc", "xeon"}},
+			{key: "usb"},
+		}, false},
+		{"duplicate keys are all kept", "cpu=epyc,cpu!=xeon", []labelConstraint{
+			{key: "cpu", value: "epyc"},
+			{key: "cpu", value: "xeon", negate: true},
+		}, false},
+		{"equal without value", "cpu=", nil, true},
+		{"not equal without value", "cpu!=", nil, true},
+		{"value without key", "=epyc", nil, true},
+		{"not equal without key", "!=epyc", nil, true},
+		{"in without value", "cpu in ()", nil, true},
+		{"in with an empty value", "cpu in (epyc,)", nil, true},
+		{"in without key", "in (epyc)", nil, true},
+		{"in without operator", "cpu (epyc)", nil, true},
+		{"in not closed", "cpu in (epyc,xeon", nil, true},
+		{"in text after the values", "cpu in (epyc) x", nil, true},
+		{"closing parenthesis alone", "cpu=epyc)", nil, true},
+		{"nested parentheses", "cpu in ((epyc))", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseSelector(test.selector)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: parseSelector(%q) = %v, want an error", test.name, test.selector, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseSelector(%q) failed: %s", test.name, test.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseSelector(%q) = %v, want %v", test.name, test.selector, got, test.want)
+		}
+	}
+}
+
+func TestMatchSelector(t *testing.T) {
+	labels := map[string]string{"cpu": "EPYC", "emulators": "yes", "usb": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"cpu=epyc", true},
+		{"cpu=xeon", false},
+		{"cpu!=xeon", true},
+		{"cpu!=epyc", false},
+		{"bmc!=openbmc", true},
+		{"bmc=openbmc", false},
+		{"emulators", true},
+		{"usb", true},
+		{"bmc", false},
+		{"cpu in (xeon,epyc)", true},
+		{"cpu in (xeon,arm)", false},
+		{"bmc in (openbmc)", false},
+		{"cpu=epyc,emulators=yes", true},
+		{"cpu=epyc,emulators=no", false},
+		{"cpu=epyc,cpu!=epyc", false},
+	}
+	for _, test := range tests {
+		constraints, err := parseSelector(test.selector)
+		if err != nil {
+			t.Fatalf("parseSelector(%q) failed: %s", test.selector, err)
+		}
+		if got := matchSelector(labels, constraints); got != test.want {
+			t.Errorf("matchSelector(%v, %q) = %t, want %t", labels, test.selector, got, test.want)
+		}
+	}
+}
+
+func TestTicketsAhead(t *testing.T) {
+	testPool.Do(func() { go poolOwner() })
+	withPool(func() {
+		ciServers.servers = []serverEntry{
+			{servername: "srv1", labels: map[string]string{"cpu": "epyc"}},
+			{servername: "srv2", labels: map[string]string{"cpu": "xeon", "usb": "yes"}},
+		}
+		waitQueues = map[int][]*queueTicket{0: {
+			{Owner: "a"},
+			{Owner: "b", Selector: "cpu=arm"},
+			{Owner: "c", Selector: "usb"},
+			{Owner: "d", Selector: "cpu in (arm,epyc)"},
+		}}
+	})
+	tests := []struct {
+		name     string
+		position int
+		free     []int
+		want     int
+	}{
+		{"head of the queue", 0, []int{0, 1}, 0},
+		{"no free server", 4, nil, 0},
+		{"ticket without selector", 1, []int{0}, 1},
+		{"selector no free server matches", 2, []int{0, 1}, 1},
+		{"tail of the queue", 4, []int{0, 1}, 3},
+		{"only the epyc server is free", 4, []int{0}, 2},
+		{"only the xeon server is free", 4, []int{1}, 2},
+	}
+	for _, test := range tests {
+		var got int
+		withPool(func() { got = ticketsAhead(0, test.position, test.free) })
+		if got != test.want {
+			t.Errorf("%s: ticketsAhead(%d, %v) = %d, want %d", test.name, test.position, test.free, got, test.want)
+		}
+	}
+	withPool(func() {
+		ciServers.servers = nil
+		waitQueues = make(map[int][]*queueTicket)
+	})
+}
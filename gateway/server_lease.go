@@ -0,0 +1,155 @@
+// OSFCI Server module - lease policies
+//
+// Each product family defines the length of a lease, the maximum length
+// a lease can reach and how many times it can be extended. A lease can
+// only be extended when nobody is waiting for that product.
+
+package main
+
+import (
+	"base/base"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// leaseLength returns the default lease length of a product
+func leaseLength(product int) time.Duration {
+	if product < 0 || product >= len(ciServersProducts) || ciServersProducts[product].LeaseLength <= 0 {
+		return time.Second * time.Duration(base.MaxServerAge)
+	}
+	return time.Second * time.Duration(ciServersProducts[product].LeaseLength)
+}
+
+// leaseMaxLength returns how long a lease of a product can last with its extensions
+func leaseMaxLength(product int) time.Duration {
+	if product < 0 || product >= len(ciServersProducts) || ciServersProducts[product].LeaseMaxLength <= 0 {
+		return leaseLength(product)
+	}
+	return time.Second * time.Duration(ciServersProducts[product].LeaseMaxLength)
+}
+
+// leaseExtension returns the new expiration of a server following its product policy
+// must be called from the pool goroutine
+func leaseExtension(index int) (time.Time, error) {
+	entry := &ciServers.servers[index]
+	product := entry.ProductIndex
+	if product < 0 || product >= len(ciServersProducts) {
+		return entry.expiration, fmt.Errorf("unknown server model")
+	}
+	if entry.state != serverAllocated || time.Now().After(entry.expiration) {
+		return entry.expiration, fmt.Errorf("lease is over")
+	}
+	if entry.preempted {
+		return entry.expiration, fmt.Errorf("server is reclaimed by a higher priority user")
+	}
+	policy := ciServersProducts[product]
+	if entry.extensions >= policy.LeaseExtensions {
+		return entry.expiration, fmt.Errorf("no extension left for this lease")
+	}
+	pruneTickets()
+	if len(waitQueues[product]) > 0 {
+		return entry.expiration, fmt.Errorf("users are waiting for a %s server", policy.Product)
+	}
+	maxEnd := entry.leaseStart.Add(time.Second * time.Duration(policy.LeaseMaxLength))
+	newEnd := entry.expiration.Add(leaseLength(product))
+	if newEnd.After(maxEnd) {
+		newEnd = maxEnd
+	}
+	if !newEnd.After(entry.expiration) {
+		return entry.expiration, fmt.Errorf("lease already reached its maximum length")
+	}
+	// Upcoming bookings must still find a server
+	pruneReservations()
+	if reservedServers(product, entry.expiration, newEnd) > len(freeServers(product)) {
+		return entry.expiration, fmt.Errorf("the server is reserved after your lease")
+	}
+	return newEnd, nil
+}
+
+// extendLease pushes back the expiration of a server, the servers of a
+// group share their lease and are extended together or not at all
+// must be called from the pool goroutine
+func extendLease(index int) error {
+	members := []int{index}
+	if ciServers.servers[index].group != "" {
+		members = groupMembers(ciServers.servers[index].group)
+	}
+	var newEnd time.Time
+	for _, i := range members {
+		end, err := leaseExtension(i)
+		if err != nil {
+			return err
+		}
+		if newEnd.IsZero() || end.Before(newEnd) {
+			newEnd = end
+		}
+	}
+	entry := &ciServers.servers[index]
+	if entry.ownerNickname != "" {
+		// The quota is shared between all the servers of the group
+		left := quotaTimeLeft(entry.ownerNickname)
+		if left == 0 {
+			return fmt.Errorf("you reached your server time quota")
+		}
+		if left > 0 {
+			left /= time.Duration(len(members))
+		}
+		if left > 0 && newEnd.After(entry.expiration.Add(left)) {
+			newEnd = entry.expiration.Add(left)
+		}
+	}
+	for _, i := range members {
+		member := &ciServers.servers[i]
+		if member.ownerNickname != "" {
+			updateUsage(member.ownerNickname, member.servername, newEnd)
+		}
+		member.expiration = newEnd
+		member.extensions++
+	}
+	return nil
+}
+
+// leaseCommand extends the lease of the server owned by the caller
+// path is /extendLease/<login>
+func leaseCommand(w http.ResponseWriter, r *http.Request, tail string, cacheIndex int) {
+	keys := strings.Split(tail, "/")
+	if len(keys) < 3 {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	command := keys[1]
+	login := keys[2]
+	if !checkAccess(w, r, login, command) {
+		w.Write([]byte("Access denied"))
+		return
+	}
+	if cacheIndex == -1 {
+		http.Error(w, "404 No active server", 404)
+		return
+	}
+	type returnValue struct {
+		RemainingTime string
+		Extensions    string
+	}
+	var myoutput returnValue
+	var err error
+	var entry serverEntry
+	withPool(func() {
+		err = extendLease(cacheIndex)
+		if err == nil {
+			savePoolState()
+		}
+		entry = ciServers.servers[cacheIndex]
+	})
+	if err != nil {
+		http.Error(w, "409 "+err.Error(), 409)
+		return
+	}
+	myoutput.RemainingTime = fmt.Sprintf("%d", entry.expiration.Unix()-time.Now().Unix())
+	myoutput.Extensions = fmt.Sprintf("%d", ciServersProducts[entry.ProductIndex].LeaseExtensions-entry.extensions)
+	returnData, _ := json.Marshal(myoutput)
+	w.Write(returnData)
+}
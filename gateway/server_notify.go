@@ -0,0 +1,139 @@
+// OSFCI Server module - wait queue notifications
+//
+// When a free server can be handed to a ticket the server is held for it
+// during a claim window: the ticket stays at the head of its queue and the
+// users behind it can't take the server. A user who asked to be notified
+// gets an email and a call to its webhook, its ticket doesn't need to be
+// polled while it waits. A ticket which doesn't claim its server within the
+// claim window is dropped.
+
+package main
+
+import (
+	"base/base"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// claimWindow is the time a server is held for the head of a queue
+var claimWindow = 5 * time.Minute
+
+// notifyTicketTimeout is the time a ticket asking to be notified is kept without being polled
+var notifyTicketTimeout = 12 * time.Hour
+
+// notifyEmail sends the notifications by email on top of the webhooks
+var notifyEmail bool
+
+// webhookTimeout is the longest time a webhook call can take
+var webhookTimeout = 5 * time.Second
+
+// queueNotification tells a user that a server is held for its ticket
+// Upercase is mandatory for JSON library parsing
+type queueNotification struct {
+	Event       string
+	Nickname    string
+	Product     string
+	Selector    string
+	Ticket      string
+	ClaimBefore time.Time
+}
+
+// ticketHeld tells if a server is held for a ticket
+func ticketHeld(ticket *queueTicket) bool {
+	return !ticket.HeldUntil.IsZero()
+}
+
+// holdServers holds a server for each ticket which can be served and returns
+// the notifications to send
+// must be called from the pool goroutine
+func holdServers() []queueNotification {
+	var notifications []queueNotification
+	pruneTickets()
+	pruneReservations()
+	held := false
+	for product := range ciServersProducts {
+		if len(waitQueues[product]) == 0 {
+			continue
+		}
+		fairShareOrder(product)
+		leaseEnd := time.Now().Add(leaseLength(product))
+		for position, ticket := range waitQueues[product] {
+			if ticketHeld(ticket) || cooldownLeft(ticket.Nickname) > 0 {
+				continue
+			}
+			constraints, _ := parseSelector(ticket.Selector)
+			free := matchingServers(freeServers(product), constraints)
+			available := len(free) - reservedServers(product, time.Now(), leaseEnd)
+			if ticketsAhead(product, position, free) >= available {
+				continue
+			}
+			ticket.HeldUntil = time.Now().Add(claimWindow)
+			held = true
+			fmt.Printf("A %s server is held for %s up to %s\n", ticket.Model, ticket.Nickname, ticket.HeldUntil.Format(time.RFC1123Z))
+			if ticket.Notify {
+				notifications = append(notifications, queueNotification{"serverHeld", ticket.Nickname, ticket.Model,
+					ticket.Selector, ticket.ID, ticket.HeldUntil})
+			}
+		}
+	}
+	if held {
+		savePoolState()
+	}
+	return notifications
+}
+
+// holdQueues holds the free servers for the heads of the queues and tells their users
+func holdQueues() {
+	var notifications []queueNotification
+	withPool(func() {
+		notifications = holdServers()
+	})
+	for _, notification := range notifications {
+		go notifyUser(notification)
+	}
+}
+
+// notifyUser sends a notification by email and to the webhook of a user
+func notifyUser(notification queueNotification) {
+	account, ok := getAccount(notification.Nickname)
+	if !ok {
+		return
+	}
+	if notifyEmail && account.Email != "" {
+		base.SendEmail(account.Email, "OSFCI "+notification.Product+" server is ready",
+			"A "+notification.Product+" server is held for you up to "+
+				notification.ClaimBefore.Format(time.RFC1123Z)+
+				". Please come back to OSFCI before that time, otherwise the server goes to the next user.")
+	}
+	if account.Webhook != "" {
+		err := callWebhook(account.Webhook, notification)
+		if err != nil {
+			fmt.Printf("Webhook of %s failed: %s\n", notification.Nickname, err)
+		}
+	}
+}
+
+// callWebhook posts a notification to a user webhook, only a public address
+// is reached and a redirection is a failure
+func callWebhook(webhook string, notification queueNotification) error {
+	content, _ := json.Marshal(notification)
+	client := base.PublicClient(webhookTimeout)
+	request, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Osfci-Event", notification.Event)
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
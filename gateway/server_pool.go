@@ -0,0 +1,148 @@
+// OSFCI Server module - pool ownership and server lifecycle
+//
+// The pool (servers, wait queues and reservations) is owned by a single
+// goroutine. Everybody else reads or changes it through withPool.
+//
+// A server goes through the following states
+//   free -> allocated -> cleaning -> free
+//                                 -> failed (cleanup didn't succeed)
+// and can be put into maintenance by an operator, a drained server goes to
+// maintenance instead of free once cleaned up. Only free servers are handed
+// to users.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type serverLifecycle string
+
+const (
+	serverFree        serverLifecycle = "free"
+	serverAllocated   serverLifecycle = "allocated"
+	serverCleaning    serverLifecycle = "cleaning"
+	serverMaintenance serverLifecycle = "maintenance"
+	serverFailed      serverLifecycle = "failed"
+)
+
+// serverTransitions lists the allowed state changes
+var serverTransitions = map[serverLifecycle][]serverLifecycle{
+	serverFree:        {serverAllocated, serverMaintenance},
+	serverAllocated:   {serverCleaning},
+	serverCleaning:    {serverFree, serverFailed, serverMaintenance},
+	serverMaintenance: {serverCleaning, serverFree},
+	serverFailed:      {serverCleaning, serverMaintenance},
+}
+
+// maxTransitions is the number of transitions kept for each server
+var maxTransitions = 32
+
+// serverTransition records a state change of a server
+// Upercase is mandatory for JSON library parsing
+type serverTransition struct {
+	Time   time.Time
+	From   serverLifecycle
+	To     serverLifecycle
+	Reason string
+}
+
+var poolRequests = make(chan func())
+
+// poolOwner runs the pool operations one after the other
+func poolOwner() {
+	for operation := range poolRequests {
+		operation()
+	}
+}
+
+// withPool runs operation on the pool goroutine and waits for its completion
+// operation must not call withPool
+func withPool(operation func()) {
+	done := make(chan bool)
+	poolRequests <- func() {
+		operation()
+		done <- true
+	}
+	<-done
+}
+
+// setServerState moves a server to a new state and records the transition
+// must be called from the pool goroutine
+func setServerState(index int, state serverLifecycle, reason string) error {
+	entry := &ciServers.servers[index]
+	allowed := false
+	for _, next := range serverTransitions[entry.state] {
+		if next == state {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("server %s can't go from %s to %s", entry.servername, entry.state, state)
+	}
+	transition := serverTransition{Time: time.Now(), From: entry.state, To: state, Reason: reason}
+	fmt.Printf("Server %s: %s -> %s (%s)\n", entry.servername, entry.state, state, reason)
+	entry.state = state
+	entry.transitions = append(entry.transitions, transition)
+	if len(entry.transitions) > maxTransitions {
+		entry.transitions = entry.transitions[len(entry.transitions)-maxTransitions:]
+	}
+	savePoolState()
+	return nil
+}
+
+// ownedServer returns the server currently leased to a session cookie or
+// shared with its user, a copy of its entry and the access of the cookie.
+// servername picks a member of a group, the first one is returned when it is
+// empty. The index is -1 if there is none.
+func ownedServer(cookie string, servername string) (int, serverEntry, sessionRole) {
+	index := -1
+	var entry serverEntry
+	var role sessionRole
+	expired := false
+	shared := false
+	withPool(func() {
+		claimRestored(cookie)
+		for i := range ciServers.servers {
+			if ciServers.servers[i].state != serverAllocated || ciServers.servers[i].currentOwner != cookie {
+				continue
+			}
+			if time.Now().After(ciServers.servers[i].expiration) {
+				expired = true
+				continue
+			}
+			if index != -1 || (servername != "" && ciServers.servers[i].servername != servername) {
+				continue
+			}
+			index = i
+			entry = ciServers.servers[i]
+			role = sessionRole{accessOwner, entry.ownerNickname}
+		}
+		shared = index == -1 && sharedServers()
+	})
+	if shared {
+		// The cookie may belong to a guest
+		nickname := cookieOwner(cookie)
+		withPool(func() {
+			for i := range ciServers.servers {
+				if nickname == "" || ciServers.servers[i].state != serverAllocated ||
+					time.Now().After(ciServers.servers[i].expiration) ||
+					(servername != "" && ciServers.servers[i].servername != servername) {
+					continue
+				}
+				if access := guestAccess(i, nickname); access != accessNone {
+					index = i
+					entry = ciServers.servers[i]
+					role = sessionRole{access, nickname}
+					return
+				}
+			}
+		})
+	}
+	if expired {
+		// The reaper is cleaning up expired leases
+		wakeReaper()
+	}
+	return index, entry, role
+}
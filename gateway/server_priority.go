@@ -0,0 +1,213 @@
+// OSFCI Server module - priority classes and preemption
+//
+// Each account has a priority class, requests signed with the account API
+// key can use a different class than the web sessions of the same account.
+// Wait queues serve the highest classes first. When preemption is enabled,
+// a waiting user can reclaim the server of a lower class holder: the holder
+// is warned and the lease ends after a grace period.
+
+package main
+
+import (
+	"base/base"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// priorityClasses are ordered from the lowest to the highest
+var priorityClasses = []string{"ci", "interactive", "maintenance"}
+
+// defaultPriority is the class of the accounts which don't have any
+var defaultPriority = "interactive"
+
+// preemptionGrace is the time left to a preempted holder, 0 disables preemption
+var preemptionGrace time.Duration
+
+// preemptingClasses are the classes allowed to reclaim servers of lower classes
+var preemptingClasses = []string{"maintenance"}
+
+// priorityRank returns the rank of a class, unknown classes are the lowest
+func priorityRank(class string) int {
+	for i := range priorityClasses {
+		if priorityClasses[i] == class {
+			return i
+		}
+	}
+	return -1
+}
+
+// canPreempt tells if a class is allowed to reclaim servers
+func canPreempt(class string) bool {
+	if preemptionGrace <= 0 {
+		return false
+	}
+	for _, preempting := range preemptingClasses {
+		if preempting == class {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPriority returns the class of a getServer request, a request signed
+// with a key of the account uses the token class if there is one. The request
+// is already allowed, the signature only picks the class. The classes of the
+// account are kept with the session
+func requestPriority(r *http.Request, cookie string, nickname string) string {
+	classes, ok := sessionClasses(cookie, nickname)
+	if !ok {
+		return defaultPriority
+	}
+	class := classes.Priority
+	if classes.TokenPriority != "" && classes.TokenPriority != class && r.Header.Get("Authorization") != "" {
+		if key, ok := signingKey(r, nickname); ok && keyAllows(key, "getServer") {
+			class = classes.TokenPriority
+		}
+	}
+	if priorityRank(class) == -1 {
+		class = defaultPriority
+	}
+	return class
+}
+
+// accountPriority are the classes of an account, empty is the default class
+// Upercase is mandatory for JSON library parsing
+type accountPriority struct {
+	Priority      string
+	TokenPriority string
+}
+
+// setAccountPriority records the classes of an account into the credential service
+func setAccountPriority(nickname string, classes accountPriority) error {
+	content, _ := json.Marshal(classes)
+	request, _ := http.NewRequest(http.MethodPut, "http://"+credentialURI+credentialPort+"/account/"+url.PathEscape(nickname)+"/priority", bytes.NewReader(content))
+	request.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("can't reach credential service: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unknown user %s", nickname)
+	}
+	forgetClasses(nickname)
+	return nil
+}
+
+// preemption is a warning to send to a preempted holder
+type preemption struct {
+	nickname   string
+	servername string
+	deadline   time.Time
+	class      string
+}
+
+// preemptServers shortens the leases of lower class holders for the tickets
+// of the product which will not get a free server
+// must be called from the pool goroutine
+func preemptServers(product int, available int) []preemption {
+	var warnings []preemption
+	// Servers already preempted are going to serve the first tickets
+	for i := range ciServers.servers {
+		if ciServers.servers[i].ProductIndex == product && ciServers.servers[i].preempted &&
+			ciServers.servers[i].state == serverAllocated {
+			available++
+		}
+	}
+	if available < 0 {
+		available = 0
+	}
+	for position, ticket := range waitQueues[product] {
+		if position < available {
+			continue
+		}
+		if !canPreempt(ticket.Priority) {
+			// The queue is ordered by class, nobody after can preempt
+			break
+		}
+		constraints, _ := parseSelector(ticket.Selector)
+		victim := -1
+		for i := range ciServers.servers {
+			entry := &ciServers.servers[i]
+			if entry.ProductIndex != product || entry.state != serverAllocated || entry.preempted || entry.retired {
+				continue
+			}
+			if priorityRank(entry.priority) >= priorityRank(ticket.Priority) || reservationHolder(i) ||
+				!matchSelector(entry.labels, constraints) {
+				continue
+			}
+			// The lowest class then the lease ending first
+			if victim == -1 || priorityRank(entry.priority) < priorityRank(ciServers.servers[victim].priority) ||
+				(priorityRank(entry.priority) == priorityRank(ciServers.servers[victim].priority) &&
+					entry.expiration.Before(ciServers.servers[victim].expiration)) {
+				victim = i
+			}
+		}
+		if victim == -1 {
+			break
+		}
+		// The servers of a group share their lease and are reclaimed together
+		deadline := time.Now().Add(preemptionGrace)
+		for _, i := range leaseMembers(victim) {
+			entry := &ciServers.servers[i]
+			entry.preempted = true
+			if deadline.Before(entry.expiration) {
+				entry.expiration = deadline
+				if entry.ownerNickname != "" {
+					updateUsage(entry.ownerNickname, entry.servername, deadline)
+				}
+			}
+			fmt.Printf("Server %s of %s is preempted by a %s user, lease ends at %s\n",
+				entry.servername, entry.ownerNickname, ticket.Priority, entry.expiration.Format(time.RFC1123Z))
+			warnings = append(warnings, preemption{entry.ownerNickname, entry.servername, entry.expiration, ticket.Priority})
+			if entry.ProductIndex == product {
+				available++
+			}
+		}
+		savePoolState()
+	}
+	return warnings
+}
+
+// reservationHolder tells if a server is used by a running booking
+// must be called from the pool goroutine
+func reservationHolder(index int) bool {
+	for _, booking := range reservations {
+		if booking.Servername == ciServers.servers[index].servername && reservationClaimed(booking) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnPreempted tells the holders of preempted servers that their lease is ending
+func warnPreempted(warnings []preemption) {
+	for _, warning := range warnings {
+		account, ok := getAccount(warning.nickname)
+		if !ok || account.Email == "" {
+			continue
+		}
+		base.SendEmail(account.Email, "OSFCI session on "+warning.servername+" is ending",
+			"Your session on "+warning.servername+" is reclaimed by a "+warning.class+
+				" user. Please save your work, the server will be released at "+
+				warning.deadline.Format(time.RFC1123Z)+".")
+	}
+}
+
+// parseClasses reads a comma separated list of priority classes
+func parseClasses(list string) []string {
+	var classes []string
+	for _, class := range strings.Split(list, ",") {
+		class = strings.TrimSpace(class)
+		if class != "" {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
@@ -0,0 +1,84 @@
+// OSFCI Server module - product families and static controllers
+//
+// Product families are read from the serverfamily section of the gateway
+// configuration and controllers are linked to them by model name.
+
+package main
+
+import (
+	"base/base"
+	"fmt"
+	"github.com/spf13/viper"
+	"sort"
+	"time"
+)
+
+// sortedKeys returns the sub keys of a configuration section in a stable order
+func sortedKeys(section string) []string {
+	var keys []string
+	for key := range viper.GetStringMap(section) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadProducts builds ciServersProducts from the serverfamily section
+func loadProducts() error {
+	for _, family := range sortedKeys("serverfamily") {
+		viperstring := "serverfamily." + family
+		var newFamily serverProduct
+		newFamily.Brand = viper.GetString(viperstring + ".Brand")
+		newFamily.Product = viper.GetString(viperstring + ".model")
+		newFamily.Active = viper.GetInt(viperstring + ".Active")
+		if newFamily.Product == "" {
+			return fmt.Errorf("server family %s has no model", family)
+		}
+		if productIndex(newFamily.Product) != -1 {
+			return fmt.Errorf("server family %s: model %s is defined twice", family, newFamily.Product)
+		}
+		// Lease policy is optional, default is a single lease of MaxServerAge
+		newFamily.LeaseLength = base.MaxServerAge
+		if viper.IsSet(viperstring + ".leaseLength") {
+			newFamily.LeaseLength = viper.GetInt(viperstring + ".leaseLength")
+		}
+		newFamily.LeaseMaxLength = newFamily.LeaseLength
+		if viper.IsSet(viperstring + ".leaseMaxLength") {
+			newFamily.LeaseMaxLength = viper.GetInt(viperstring + ".leaseMaxLength")
+		}
+		newFamily.LeaseExtensions = viper.GetInt(viperstring + ".leaseExtensions")
+		fmt.Printf("Server family %s: %s %s\n", family, newFamily.Brand, newFamily.Product)
+		ciServersProducts = append(ciServersProducts, newFamily)
+	}
+	return nil
+}
+
+// loadControllers adds the statically configured controllers to the pool
+// A controller whose SUTtype doesn't match any family model is rejected
+func loadControllers() {
+	for _, ctrl := range sortedKeys("controller") {
+		viperstring := "controller." + ctrl
+		var newEntry serverEntry
+		newEntry.servername = viper.GetString(viperstring + ".servername")
+		newEntry.ip = viper.GetString(viperstring + ".ip")
+		newEntry.tcpPort = viper.GetString(viperstring + ".tcpPort")
+		newEntry.compileIP = viper.GetString(viperstring + ".compilerIP")
+		newEntry.bmcIP = viper.GetString(viperstring + ".SUTbmcIP")
+		newEntry.labels = normalizeLabels(viper.GetStringMapString(viperstring + ".labels"))
+		newEntry.currentOwner = ""
+		newEntry.gitToken = ""
+		newEntry.expiration = time.Now()
+		servertype := viper.GetString(viperstring + ".SUTtype")
+		newEntry.ProductIndex = productIndex(servertype)
+		if newEntry.ProductIndex == -1 {
+			fmt.Printf("Error: controller %s (%s) has an unknown SUTtype \"%s\", it is not added to the pool\n",
+				ctrl, newEntry.servername, servertype)
+			continue
+		}
+		fmt.Printf("Controller %s: %s is a %s\n", ctrl, newEntry.servername, servertype)
+		newEntry.state = serverFree
+		withPool(func() {
+			ciServers.servers = append(ciServers.servers, newEntry)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// OSFCI Server module - per product wait queues
+//
+// Each product has its own queue, ordered by arrival or by fair share. A
+// user who can't get a server receives a ticket and keeps it alive by
+// polling getServer. A freed server is held for the tickets at the head of
+// the queue.
+
+package main
+
+import (
+	"base/base"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ticketTimeout is the time after which a ticket which has not been polled is dropped
+var ticketTimeout = 120 * time.Second
+
+// queueTicket is a place into a product wait queue
+// Upercase is mandatory for JSON library parsing
+type queueTicket struct {
+	ID       string
+	Owner    string
+	Nickname string
+	Priority string
+	Selector string
+	Product  int
+	Model    string
+	Created  time.Time
+	LastSeen time.Time
+	// Notify tickets are kept without polling, their user is told when a
+	// server is held for them up to HeldUntil
+	Notify    bool
+	HeldUntil time.Time
+}
+
+// waitQueues is indexed by ProductIndex and owned by the pool goroutine
+var waitQueues = make(map[int][]*queueTicket)
+
+// pruneTickets drops the tickets from clients which stopped polling and the
+// ones which didn't claim the server held for them
+// must be called from the pool goroutine
+func pruneTickets() {
+	for product, queue := range waitQueues {
+		var alive []*queueTicket
+		for _, ticket := range queue {
+			if ticketHeld(ticket) && time.Now().After(ticket.HeldUntil) {
+				if ticket.LastSeen.Before(ticket.HeldUntil.Add(-claimWindow)) {
+					fmt.Printf("%s didn't claim the %s server held for them\n", ticket.Nickname, ticket.Model)
+					continue
+				}
+				// The client came back but couldn't get the server, it is held again later
+				ticket.HeldUntil = time.Time{}
+			}
+			timeout := ticketTimeout
+			if ticket.Notify {
+				timeout = notifyTicketTimeout
+			}
+			if time.Since(ticket.LastSeen) < timeout || ticketHeld(ticket) {
+				alive = append(alive, ticket)
+			}
+		}
+		waitQueues[product] = alive
+	}
+}
+
+// findTicket returns the position of the ticket owned by cookie into the product
+// queue. The ticket ID is optional, a client which lost it keeps its position.
+// must be called from the pool goroutine
+func findTicket(product int, cookie string, ticketID string) int {
+	for i, ticket := range waitQueues[product] {
+		if ticket.Owner != cookie {
+			continue
+		}
+		if ticketID == "" || ticket.ID == ticketID {
+			return i
+		}
+	}
+	return -1
+}
+
+// enqueueTicket adds a new ticket at the tail of the product queue
+// must be called from the pool goroutine
+func enqueueTicket(product int, cookie string, nickname string, priority string) {
+	ticket := &queueTicket{
+		ID:       base.GenerateAccountACKLink(16),
+		Owner:    cookie,
+		Nickname: nickname,
+		Priority: priority,
+		Product:  product,
+		Model:    ciServersProducts[product].Product,
+		Created:  time.Now(),
+		LastSeen: time.Now(),
+	}
+	waitQueues[product] = append(waitQueues[product], ticket)
+}
+
+// removeTicket drops a ticket from the product queue
+// must be called from the pool goroutine
+func removeTicket(product int, position int) {
+	queue := waitQueues[product]
+	waitQueues[product] = append(queue[:position:position], queue[position+1:]...)
+}
+
+// freeServers returns the index of the servers of a product which can be allocated
+// must be called from the pool goroutine
+func freeServers(product int) []int {
+	var free []int
+	for i := range ciServers.servers {
+		if ciServers.servers[i].retired || ciServers.servers[i].quarantined || ciServers.servers[i].state != serverFree {
+			continue
+		}
+		if ciServers.servers[i].ProductIndex == product {
+			free = append(free, i)
+		}
+	}
+	return free
+}
+
+// countServers returns the number of servers of a product which are in service
+// must be called from the pool goroutine
+func countServers(product int) int {
+	count := 0
+	for i := range ciServers.servers {
+		if ciServers.servers[i].ProductIndex != product || ciServers.servers[i].retired {
+			continue
+		}
+		if ciServers.servers[i].state != serverMaintenance && ciServers.servers[i].state != serverFailed {
+			count++
+		}
+	}
+	return count
+}
+
+// estimateWait gives the time a ticket at position will wait assuming that
+// each lease lasts up to its end
+// must be called from the pool goroutine
+func estimateWait(product int, position int, free int) time.Duration {
+	var expirations []time.Time
+	for i := range ciServers.servers {
+		if ciServers.servers[i].retired || ciServers.servers[i].state != serverAllocated {
+			continue
+		}
+		if ciServers.servers[i].ProductIndex == product && !time.Now().After(ciServers.servers[i].expiration) {
+			expirations = append(expirations, ciServers.servers[i].expiration)
+		}
+	}
+	wait := time.Second
+	if len(expirations) > 0 && position >= free {
+		sort.Slice(expirations, func(i, j int) bool { return expirations[i].Before(expirations[j]) })
+		rank := position - free
+		wait = time.Until(expirations[rank%len(expirations)]) +
+			time.Duration(rank/len(expirations))*leaseLength(product)
+	}
+	// A zero wait time means that a server is allocated
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// queueSnapshot returns a copy of the tickets as to persist them
+// must be called from the pool goroutine
+func queueSnapshot() []queueTicket {
+	var tickets []queueTicket
+	for _, queue := range waitQueues {
+		for _, ticket := range queue {
+			tickets = append(tickets, *ticket)
+		}
+	}
+	return tickets
+}
+
+// restoreQueues rebuilds the wait queues from persisted tickets
+// Clients are given a full timeout to come back after a gateway restart
+// must be called from the pool goroutine
+func restoreQueues(tickets []queueTicket) {
+	// Families might have been reordered into the configuration
+	for i := range tickets {
+		tickets[i].Product = productIndex(tickets[i].Model)
+	}
+	sort.SliceStable(tickets, func(i, j int) bool { return tickets[i].Product < tickets[j].Product })
+	for i := range tickets {
+		ticket := tickets[i]
+		if ticket.Product == -1 {
+			continue
+		}
+		ticket.LastSeen = time.Now()
+		waitQueues[ticket.Product] = append(waitQueues[ticket.Product], &ticket)
+	}
+}
@@ -0,0 +1,258 @@
+// OSFCI Server module - per user quotas and fair share
+//
+// The server time of each user is recorded by nickname. It limits the number
+// of servers a user holds at once, the hours booked per day and per week and
+// enforces a cooldown between two sessions. When users are waiting for a
+// product, the ones who used the servers the less recently go first.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// quotaMaxServers is the number of servers a user can hold at once, 0 is unlimited
+var quotaMaxServers int
+
+// quotaPerDay and quotaPerWeek limit the server time of a user, 0 is unlimited
+var quotaPerDay time.Duration
+var quotaPerWeek time.Duration
+
+// quotaCooldown is the time a user must wait after a session to get a new server
+var quotaCooldown time.Duration
+
+// quotaMinLease is the shortest lease granted, a quota with less time left is exhausted
+var quotaMinLease = time.Minute
+
+// fairShareWindow is the usage period considered to order the wait queues,
+// 0 keeps the queues in arrival order
+var fairShareWindow = 24 * time.Hour
+
+// usageSession is a lease of a server, End is the lease end while it runs
+// Upercase is mandatory for JSON library parsing
+type usageSession struct {
+	Servername string
+	Start      time.Time
+	End        time.Time
+	Running    bool
+}
+
+// userUsage is the server time of a user
+// Upercase is mandatory for JSON library parsing
+type userUsage struct {
+	Nickname string
+	Sessions []usageSession
+	LastEnd  time.Time
+}
+
+// usages are indexed by nickname and owned by the pool goroutine
+var usages = make(map[string]*userUsage)
+
+// usageRetention is the time after which a session is forgotten
+var usageRetention = 7 * 24 * time.Hour
+
+// getUsage returns the usage record of a user
+// must be called from the pool goroutine
+func getUsage(nickname string) *userUsage {
+	usage, ok := usages[nickname]
+	if !ok {
+		usage = &userUsage{Nickname: nickname}
+		usages[nickname] = usage
+	}
+	return usage
+}
+
+// pruneUsages forgets the sessions which are too old to matter
+// must be called from the pool goroutine
+func pruneUsages() {
+	retention := usageRetention
+	if fairShareWindow > retention {
+		retention = fairShareWindow
+	}
+	for nickname, usage := range usages {
+		var recent []usageSession
+		for _, session := range usage.Sessions {
+			// A running session ends with its lease
+			if time.Since(session.End) < retention {
+				recent = append(recent, session)
+			}
+		}
+		usage.Sessions = recent
+		if len(recent) == 0 && time.Since(usage.LastEnd) > quotaCooldown {
+			delete(usages, nickname)
+		}
+	}
+}
+
+// startUsage records the beginning of a lease
+// must be called from the pool goroutine
+func startUsage(nickname string, servername string, end time.Time) {
+	usage := getUsage(nickname)
+	usage.Sessions = append(usage.Sessions, usageSession{Servername: servername, Start: time.Now(), End: end, Running: true})
+}
+
+// updateUsage moves the end of a running lease after an extension
+// must be called from the pool goroutine
+func updateUsage(nickname string, servername string, end time.Time) {
+	usage := getUsage(nickname)
+	for i := range usage.Sessions {
+		if usage.Sessions[i].Running && usage.Sessions[i].Servername == servername {
+			usage.Sessions[i].End = end
+		}
+	}
+}
+
+// endUsage records the end of a lease
+// must be called from the pool goroutine
+func endUsage(nickname string, servername string) {
+	usage := getUsage(nickname)
+	for i := range usage.Sessions {
+		if usage.Sessions[i].Running && usage.Sessions[i].Servername == servername {
+			usage.Sessions[i].Running = false
+			if time.Now().Before(usage.Sessions[i].End) {
+				usage.Sessions[i].End = time.Now()
+			}
+		}
+	}
+	usage.LastEnd = time.Now()
+}
+
+// usedTime returns the server time booked by a user since the beginning of
+// the window, running leases are counted up to their end
+// must be called from the pool goroutine
+func usedTime(nickname string, window time.Duration) time.Duration {
+	usage, ok := usages[nickname]
+	if !ok {
+		return 0
+	}
+	from := time.Now().Add(-window)
+	var used time.Duration
+	for _, session := range usage.Sessions {
+		start := session.Start
+		if start.Before(from) {
+			start = from
+		}
+		if session.End.After(start) {
+			used += session.End.Sub(start)
+		}
+	}
+	return used
+}
+
+// quotaTimeLeft returns the server time a user can still book, negative if unlimited
+// must be called from the pool goroutine
+func quotaTimeLeft(nickname string) time.Duration {
+	left := time.Duration(-1)
+	for _, limit := range []struct {
+		quota  time.Duration
+		window time.Duration
+	}{{quotaPerDay, 24 * time.Hour}, {quotaPerWeek, 7 * 24 * time.Hour}} {
+		if limit.quota <= 0 {
+			continue
+		}
+		remaining := limit.quota - usedTime(nickname, limit.window)
+		if remaining < quotaMinLease {
+			remaining = 0
+		}
+		if left < 0 || remaining < left {
+			left = remaining
+		}
+	}
+	return left
+}
+
+// cooldownLeft returns the time a user still has to wait after its last session
+// must be called from the pool goroutine
+func cooldownLeft(nickname string) time.Duration {
+	usage, ok := usages[nickname]
+	if !ok || quotaCooldown <= 0 {
+		return 0
+	}
+	left := time.Until(usage.LastEnd.Add(quotaCooldown))
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// heldServers returns the number of servers leased to a user
+// must be called from the pool goroutine
+func heldServers(nickname string) int {
+	count := 0
+	for i := range ciServers.servers {
+		if ciServers.servers[i].state == serverAllocated && ciServers.servers[i].ownerNickname == nickname {
+			count++
+		}
+	}
+	return count
+}
+
+// quotaCheck tells if a user can get one more server
+// must be called from the pool goroutine
+func quotaCheck(nickname string) error {
+	if quotaMaxServers > 0 && heldServers(nickname) >= quotaMaxServers {
+		return fmt.Errorf("you already hold %d servers which is the maximum", quotaMaxServers)
+	}
+	if quotaTimeLeft(nickname) == 0 {
+		return fmt.Errorf("you reached your server time quota, please come back later")
+	}
+	return nil
+}
+
+// fairShareOrder sorts a wait queue. The tickets a server is held for stay
+// first and users cooling down go last. The others are ordered by priority
+// class, the highest first. Within a class the users who used servers the
+// less recently go first. The time spent waiting is deduced from the usage
+// so that heavy users are not waiting forever.
+// must be called from the pool goroutine
+func fairShareOrder(product int) {
+	queue := waitQueues[product]
+	score := make(map[*queueTicket]time.Duration)
+	cooling := make(map[*queueTicket]bool)
+	for _, ticket := range queue {
+		if fairShareWindow > 0 {
+			score[ticket] = usedTime(ticket.Nickname, fairShareWindow) - time.Since(ticket.Created)
+		}
+		cooling[ticket] = cooldownLeft(ticket.Nickname) > 0
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		if ticketHeld(queue[i]) != ticketHeld(queue[j]) {
+			return ticketHeld(queue[i])
+		}
+		if cooling[queue[i]] != cooling[queue[j]] {
+			return !cooling[queue[i]]
+		}
+		if queue[i].Priority != queue[j].Priority {
+			return priorityRank(queue[i].Priority) > priorityRank(queue[j].Priority)
+		}
+		return score[queue[i]] < score[queue[j]]
+	})
+}
+
+// usageSnapshot returns a copy of the usages as to persist them
+// must be called from the pool goroutine
+func usageSnapshot() []userUsage {
+	var list []userUsage
+	for _, usage := range usages {
+		copied := *usage
+		copied.Sessions = append([]usageSession(nil), usage.Sessions...)
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list
+}
+
+// restoreUsages rebuilds the usages from their persisted copy, the usages
+// counted since we started are kept
+// must be called from the pool goroutine
+func restoreUsages(list []userUsage) {
+	for i := range list {
+		usage := list[i]
+		if _, ok := usages[usage.Nickname]; !ok {
+			usages[usage.Nickname] = &usage
+		}
+	}
+	pruneUsages()
+}
@@ -0,0 +1,119 @@
+// OSFCI Server module - lease reaper
+//
+// The reaper releases the expired leases. A released server is powered off
+// and its compile node cleaned up. It becomes allocatable again only once
+// both the controller and the compile node confirmed the cleanup, a server
+// which can't be cleaned up is failed and never handed to a user.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// reaperInterval is the time between two scans of the pool
+var reaperInterval = 5 * time.Second
+
+// maxCleanupBackoff is the longest time between two cleanup attempts
+var maxCleanupBackoff = 5 * time.Minute
+
+// maxCleanupAttempts is the number of failed cleanups after which a server is failed
+var maxCleanupAttempts = 5
+
+var reaperWakeup = make(chan bool, 1)
+
+// wakeReaper asks the reaper to scan the pool without waiting
+func wakeReaper() {
+	select {
+	case reaperWakeup <- true:
+	default:
+	}
+}
+
+// leaseReaper is scanning the pool for expired leases
+func leaseReaper() {
+	for {
+		select {
+		case <-reaperWakeup:
+		case <-time.After(reaperInterval):
+		}
+		reapLeases()
+		holdQueues()
+	}
+}
+
+// reapLeases releases the expired leases and starts the pending cleanups
+func reapLeases() {
+	var pending []serverEntry
+	withPool(func() {
+		for i := range ciServers.servers {
+			entry := &ciServers.servers[i]
+			if entry.state == serverAllocated && time.Now().After(entry.expiration) {
+				if entry.ownerNickname != "" {
+					endUsage(entry.ownerNickname, entry.servername)
+				}
+				entry.currentOwner = ""
+				entry.ownerNickname = ""
+				entry.gitToken = ""
+				entry.cleanupFails = 0
+				entry.cleanupRetry = time.Now()
+				reason := "lease expired"
+				if entry.preempted {
+					reason = "lease preempted"
+				}
+				entry.preempted = false
+				entry.group = ""
+				entry.guests = nil
+				setServerState(i, serverCleaning, reason)
+			}
+			if entry.state == serverCleaning && !time.Now().Before(entry.cleanupRetry) {
+				// No other attempt must be started while this one is running
+				entry.cleanupRetry = time.Now().Add(maxCleanupBackoff)
+				pending = append(pending, *entry)
+			}
+		}
+	})
+
+	// A slow controller must not delay the other ones
+	for _, entry := range pending {
+		go cleanupServer(entry)
+	}
+}
+
+// cleanupServer resets a server and makes it allocatable again if that succeeded
+// A server which can't be cleaned up goes to failed
+func cleanupServer(entry serverEntry) {
+	err := resetServer(entry)
+	withPool(func() {
+		index := findServer(entry.servername)
+		if index == -1 || ciServers.servers[index].state != serverCleaning {
+			return
+		}
+		server := &ciServers.servers[index]
+		if err == nil {
+			server.cleanupFails = 0
+			if server.drain {
+				setServerState(index, serverMaintenance, "cleanup succeeded, server is drained")
+				return
+			}
+			setServerState(index, serverFree, "cleanup succeeded")
+			return
+		}
+		server.cleanupFails++
+		if server.cleanupFails >= maxCleanupAttempts {
+			setServerState(index, serverFailed, fmt.Sprintf("cleanup failed %d times: %s", server.cleanupFails, err))
+			return
+		}
+		backoff := reaperInterval << uint(server.cleanupFails)
+		if backoff > maxCleanupBackoff || backoff <= 0 {
+			backoff = maxCleanupBackoff
+		}
+		server.cleanupRetry = time.Now().Add(backoff)
+		fmt.Printf("Cleanup of %s failed (attempt %d), retrying in %s: %s\n", server.servername, server.cleanupFails, backoff, err)
+	})
+	if err == nil {
+		// The freed server is held for the head of its queue
+		wakeReaper()
+	}
+}
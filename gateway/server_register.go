@@ -0,0 +1,189 @@
+// OSFCI Server module - controllers registration
+//
+// Controllers register themselves at startup on an internal port of the
+// gateway and keep sending heartbeats. A controller which stops sending
+// them is retired from the pool up to its next registration.
+// The port is only opened with CONTROLLER_SECRET, which each request
+// carries. It is plain http so it must stay on the lab network or behind a
+// TLS proxy the controllers reach with an https:// GATEWAY_URI. A controller
+// can't take the name of one of the configuration.
+
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// controllerTCPPort is the internal port used by the controllers to register
+var controllerTCPPort string
+
+// controllerSecret is shared between the gateway and the controllers
+var controllerSecret string
+
+// heartbeatTimeout is the time after which a silent controller is retired
+var heartbeatTimeout = 90 * time.Second
+
+// controllerRegistration is sent by a controller when it starts
+// Upercase is mandatory for JSON library parsing
+type controllerRegistration struct {
+	Servername string
+	IP         string
+	TCPPort    string
+	CompileIP  string
+	BMCIP      string
+	Product    string
+	Labels     map[string]string
+}
+
+// findServer returns the index of a server into ciServers
+// must be called from the pool goroutine
+func findServer(servername string) int {
+	for i := range ciServers.servers {
+		if ciServers.servers[i].servername == servername {
+			return i
+		}
+	}
+	return -1
+}
+
+// registerController adds a controller to the pool or updates its entry
+func registerController(registration controllerRegistration) error {
+	if registration.Servername == "" || registration.IP == "" || registration.TCPPort == "" {
+		return fmt.Errorf("servername, ip and tcp port are mandatory")
+	}
+	product := productIndex(registration.Product)
+	if product == -1 {
+		return fmt.Errorf("unknown server model %s", registration.Product)
+	}
+	var err error
+	withPool(func() {
+		index := findServer(registration.Servername)
+		if index != -1 && !ciServers.servers[index].dynamic {
+			err = fmt.Errorf("server %s is configured on the gateway", registration.Servername)
+			return
+		}
+		if index == -1 {
+			var newEntry serverEntry
+			newEntry.servername = registration.Servername
+			newEntry.expiration = time.Now()
+			newEntry.state = serverFree
+			ciServers.servers = append(ciServers.servers, newEntry)
+			index = len(ciServers.servers) - 1
+			fmt.Printf("Controller %s joined the pool\n", registration.Servername)
+		} else {
+			fmt.Printf("Controller %s registered again\n", registration.Servername)
+		}
+		// An allocated server keeps its lease
+		entry := &ciServers.servers[index]
+		entry.ip = registration.IP
+		entry.tcpPort = registration.TCPPort
+		entry.compileIP = registration.CompileIP
+		entry.bmcIP = registration.BMCIP
+		entry.labels = normalizeLabels(registration.Labels)
+		entry.ProductIndex = product
+		entry.dynamic = true
+		entry.retired = false
+		entry.lastHeartbeat = time.Now()
+		savePoolState()
+	})
+	return err
+}
+
+// controllerHeartbeat records that a controller is still alive
+func controllerHeartbeat(servername string) bool {
+	known := false
+	withPool(func() {
+		index := findServer(servername)
+		if index == -1 || !ciServers.servers[index].dynamic || ciServers.servers[index].retired {
+			// The controller must register again
+			return
+		}
+		ciServers.servers[index].lastHeartbeat = time.Now()
+		known = true
+	})
+	return known
+}
+
+// retireController takes a server out of the pool
+// must be called from the pool goroutine
+func retireController(index int) {
+	if ciServers.servers[index].retired {
+		return
+	}
+	fmt.Printf("Controller %s retired from the pool\n", ciServers.servers[index].servername)
+	if ciServers.servers[index].currentOwner != "" && time.Now().Before(ciServers.servers[index].expiration) {
+		fmt.Printf("Server %s was allocated when it got retired\n", ciServers.servers[index].servername)
+	}
+	ciServers.servers[index].retired = true
+	savePoolState()
+}
+
+// controllersWatchdog retires the controllers which stopped sending heartbeats
+func controllersWatchdog() {
+	for {
+		time.Sleep(heartbeatTimeout / 3)
+		withPool(func() {
+			for i := range ciServers.servers {
+				if ciServers.servers[i].dynamic && time.Since(ciServers.servers[i].lastHeartbeat) > heartbeatTimeout {
+					retireController(i)
+				}
+			}
+		})
+	}
+}
+
+// controllerCallback serves the controllers requests
+// /controller/register, /controller/heartbeat/<servername>, /controller/unregister/<servername>
+func controllerCallback(w http.ResponseWriter, r *http.Request) {
+	if controllerSecret == "" ||
+		!hmac.Equal([]byte(r.Header.Get("X-Osfci-Secret")), []byte(controllerSecret)) {
+		http.Error(w, "401 Access denied", 401)
+		return
+	}
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) < 3 {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	switch path[2] {
+	case "register":
+		if r.Method != http.MethodPost {
+			http.Error(w, "401 Unknown request", 401)
+			return
+		}
+		var registration controllerRegistration
+		err := json.NewDecoder(r.Body).Decode(&registration)
+		if err != nil {
+			http.Error(w, "400 Malformed registration", 400)
+			return
+		}
+		err = registerController(registration)
+		if err != nil {
+			http.Error(w, "400 "+err.Error(), 400)
+			return
+		}
+	case "heartbeat":
+		if len(path) < 4 || !controllerHeartbeat(path[3]) {
+			http.Error(w, "404 Unknown controller", 404)
+			return
+		}
+	case "unregister":
+		if len(path) < 4 {
+			http.Error(w, "401 Malformed URI", 401)
+			return
+		}
+		withPool(func() {
+			index := findServer(path[3])
+			if index != -1 && ciServers.servers[index].dynamic {
+				retireController(index)
+			}
+		})
+	default:
+		http.Error(w, "401 Unknown controller command", 401)
+	}
+}
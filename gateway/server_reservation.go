@@ -0,0 +1,272 @@
+// OSFCI Server module - advance reservations
+//
+// A user can book a server of a given product for a time slot. During
+// that slot one server of the product is kept for the booking owner who
+// gets it through getServer without waiting into the queue.
+
+package main
+
+import (
+	"base/base"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxReservationLength is the longest slot which can be booked
+var maxReservationLength = 4 * time.Hour
+
+// reservation is a booked time slot
+// Upercase is mandatory for JSON library parsing
+type reservation struct {
+	ID         string
+	Product    string
+	Owner      string
+	Start      time.Time
+	End        time.Time
+	Servername string `json:",omitempty"`
+	Cookie     string `json:",omitempty"`
+}
+
+// reservations are owned by the pool goroutine
+var reservations []reservation
+
+// reservationRequest is the body of a booking request
+type reservationRequest struct {
+	Product string
+	Start   time.Time
+	End     time.Time
+}
+
+// pruneReservations drops the slots which are over
+// must be called from the pool goroutine
+func pruneReservations() {
+	var current []reservation
+	for _, booking := range reservations {
+		if time.Now().Before(booking.End) {
+			current = append(current, booking)
+		}
+	}
+	reservations = current
+}
+
+// reservationClaimed tells if the booking owner got its server
+// must be called from the pool goroutine
+func reservationClaimed(booking reservation) bool {
+	if booking.Servername == "" {
+		return false
+	}
+	for i := range ciServers.servers {
+		if ciServers.servers[i].servername == booking.Servername {
+			return ciServers.servers[i].currentOwner == booking.Cookie &&
+				time.Now().Before(ciServers.servers[i].expiration)
+		}
+	}
+	return false
+}
+
+// findActiveReservation returns the running booking of owner for a product
+// must be called from the pool goroutine
+func findActiveReservation(product int, owner string) int {
+	for i, booking := range reservations {
+		if booking.Owner == owner && productIndex(booking.Product) == product &&
+			!time.Now().Before(booking.Start) && time.Now().Before(booking.End) {
+			return i
+		}
+	}
+	return -1
+}
+
+// reservedServers returns how many servers of a product must be kept for
+// bookings overlapping the from - to window
+// must be called from the pool goroutine
+func reservedServers(product int, from time.Time, to time.Time) int {
+	count := 0
+	for _, booking := range reservations {
+		if productIndex(booking.Product) != product {
+			continue
+		}
+		if booking.Start.Before(to) && booking.End.After(from) && !reservationClaimed(booking) {
+			count++
+		}
+	}
+	return count
+}
+
+// createReservation validates and books a slot
+// must be called from the pool goroutine
+func createReservation(owner string, request reservationRequest) (reservation, error) {
+	var booking reservation
+	product := productIndex(request.Product)
+	if product == -1 {
+		return booking, fmt.Errorf("unknown server model %s", request.Product)
+	}
+	if !request.Start.Before(request.End) {
+		return booking, fmt.Errorf("reservation must end after it starts")
+	}
+	if request.End.Before(time.Now()) {
+		return booking, fmt.Errorf("reservation is in the past")
+	}
+	if request.End.Sub(request.Start) > maxReservationLength {
+		return booking, fmt.Errorf("reservation can't be longer than %s", maxReservationLength)
+	}
+	overlapping := 0
+	for _, existing := range reservations {
+		if productIndex(existing.Product) != product {
+			continue
+		}
+		if existing.Start.Before(request.End) && existing.End.After(request.Start) {
+			if existing.Owner == owner {
+				return booking, fmt.Errorf("you already have a reservation during that slot")
+			}
+			overlapping++
+		}
+	}
+	if overlapping >= countServers(product) {
+		return booking, fmt.Errorf("no %s server left during that slot", request.Product)
+	}
+	booking.ID = base.GenerateAccountACKLink(12)
+	booking.Product = request.Product
+	booking.Owner = owner
+	booking.Start = request.Start.UTC()
+	booking.End = request.End.UTC()
+	reservations = append(reservations, booking)
+	sort.SliceStable(reservations, func(i, j int) bool { return reservations[i].Start.Before(reservations[j].Start) })
+	return booking, nil
+}
+
+// cancelReservation removes a booking owned by owner
+// must be called from the pool goroutine
+func cancelReservation(owner string, id string) bool {
+	for i, booking := range reservations {
+		if booking.ID == id && booking.Owner == owner {
+			reservations = append(reservations[:i], reservations[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// listReservations returns the current bookings of a product, all products
+// if product is empty, or the one of an owner if owner is set
+func listReservations(product string, owner string) []reservation {
+	var list []reservation
+	withPool(func() {
+		pruneReservations()
+		for _, booking := range reservations {
+			if product != "" && booking.Product != product {
+				continue
+			}
+			if owner != "" && booking.Owner != owner {
+				continue
+			}
+			// The session cookie must never leave the gateway
+			booking.Cookie = ""
+			list = append(list, booking)
+		}
+	})
+	return list
+}
+
+// publicReservations returns the booked slots of a product, all products if
+// product is empty, without their owners. They are shown to everyone
+func publicReservations(product string) []reservation {
+	list := listReservations(product, "")
+	for i := range list {
+		list[i].Owner = ""
+	}
+	return list
+}
+
+// icalEscape escapes text values of an iCal feed (RFC 5545)
+func icalEscape(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\n", "\\n")
+	return replacer.Replace(value)
+}
+
+// reservationsCalendar builds an iCal feed of the bookings
+func reservationsCalendar(host string, list []reservation) string {
+	const icalTime = "20060102T150405Z"
+	var calendar strings.Builder
+	calendar.WriteString("BEGIN:VCALENDAR\r\n")
+	calendar.WriteString("VERSION:2.0\r\n")
+	calendar.WriteString("PRODID:-//OSFCI//Reservations//EN\r\n")
+	calendar.WriteString("CALSCALE:GREGORIAN\r\n")
+	for _, booking := range list {
+		calendar.WriteString("BEGIN:VEVENT\r\n")
+		calendar.WriteString("UID:" + booking.ID + "@" + host + "\r\n")
+		calendar.WriteString("DTSTAMP:" + time.Now().UTC().Format(icalTime) + "\r\n")
+		calendar.WriteString("DTSTART:" + booking.Start.UTC().Format(icalTime) + "\r\n")
+		calendar.WriteString("DTEND:" + booking.End.UTC().Format(icalTime) + "\r\n")
+		summary := booking.Product + " reserved"
+		if booking.Owner != "" {
+			summary += " by " + booking.Owner
+		}
+		calendar.WriteString("SUMMARY:" + icalEscape(summary) + "\r\n")
+		calendar.WriteString("END:VEVENT\r\n")
+	}
+	calendar.WriteString("END:VCALENDAR\r\n")
+	return calendar.String()
+}
+
+// reservationCommand manages the bookings of a signed in user
+// path is /reservation/<login>/<id>
+func reservationCommand(w http.ResponseWriter, r *http.Request, tail string) {
+	keys := strings.Split(tail, "/")
+	if len(keys) < 3 {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	command := keys[1]
+	login := keys[2]
+	if !checkAccess(w, r, login, command) {
+		w.Write([]byte("Access denied"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		returnData, _ := json.Marshal(listReservations("", login))
+		w.Write(returnData)
+	case http.MethodPost:
+		var request reservationRequest
+		err := json.Unmarshal(base.HTTPGetBody(r), &request)
+		if err != nil {
+			http.Error(w, "400 Malformed reservation", 400)
+			return
+		}
+		var booking reservation
+		withPool(func() {
+			pruneReservations()
+			booking, err = createReservation(login, request)
+			if err == nil {
+				savePoolState()
+			}
+		})
+		if err != nil {
+			http.Error(w, "409 "+err.Error(), 409)
+			return
+		}
+		returnData, _ := json.Marshal(booking)
+		w.Write(returnData)
+	case http.MethodDelete:
+		if len(keys) < 4 {
+			http.Error(w, "401 Malformed URI", 401)
+			return
+		}
+		found := false
+		withPool(func() {
+			found = cancelReservation(login, keys[3])
+			if found {
+				savePoolState()
+			}
+		})
+		if !found {
+			http.Error(w, "404 Unknown reservation", 404)
+		}
+	default:
+		http.Error(w, "401 Unknown request", 401)
+	}
+}
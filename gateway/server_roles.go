@@ -0,0 +1,152 @@
+// OSFCI Server module - roles and permissions
+//
+// Every command needs a permission and each role of base.Roles is given the
+// permissions of its level. checkAccess is the only place where they are
+// checked, against the role of the owner of the key which signed the
+// request. The public commands need no account, the other ones refuse the
+// requests which are not signed. A command which is not listed is refused.
+// The commands of the web sessions need the use permission every role has,
+// they are only restricted by the scopes of the session.
+// The pool administration commands are named admin/<action>.
+
+package main
+
+import (
+	"base/base"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The permissions the commands need
+const (
+	// no account needed
+	permissionPublic = "public"
+	// the servers, the builds and the own account of the user
+	permissionUse = "use"
+	// the servers pool of every user
+	permissionPool = "pool"
+	// the priorities and the roles of the users
+	permissionAccounts = "accounts"
+)
+
+// permissionRoles is the lowest role having each permission
+var permissionRoles = map[string]string{
+	permissionUse:      base.RoleUser,
+	permissionPool:     base.RoleOperator,
+	permissionAccounts: base.RoleAdmin,
+}
+
+// commandPermissions is the permission each command needs
+var commandPermissions = map[string]string{
+	// login and account creation
+	"getToken":               permissionPublic,
+	"validateUser":           permissionPublic,
+	"resetPassword":          permissionPublic,
+	"generatePasswordLnkRst": permissionPublic,
+	"createUser":             permissionPublic,
+	"logout":                 permissionPublic,
+	"oidcProvider":           permissionPublic,
+	"oidcLogin":              permissionPublic,
+	"oidcCallback":           permissionPublic,
+	// sessions and the wait queues
+	"getServer":   permissionUse,
+	"getServers":  permissionUse,
+	"stopServer":  permissionUse,
+	"extendLease": permissionUse,
+	"reservation": permissionUse,
+	"share":       permissionUse,
+	// firmware builds
+	"gitToken":          permissionUse,
+	"buildbiosfirmware": permissionUse,
+	"buildbmcfirmware":  permissionUse,
+	"getOpenBMC":        permissionUse,
+	"getLinuxBoot":      permissionUse,
+	"getOpenBMCLog":     permissionUse,
+	"getLinuxBootLog":   permissionUse,
+	// power and emulators
+	"poweron":          permissionUse,
+	"poweroff":         permissionUse,
+	"startbmc":         permissionUse,
+	"startsmbios":      permissionUse,
+	"resetEmulator":    permissionUse,
+	"bmcfirmware":      permissionUse,
+	"biosfirmware":     permissionUse,
+	"loadbuiltsmbios":  permissionUse,
+	"loadbuiltopenbmc": permissionUse,
+	// account, DELETE /user/<login> has no command
+	"userGetInfo":   permissionUse,
+	"updateAccount": permissionUse,
+	"updateAvatar":  permissionUse,
+	"getAvatar":     permissionUse,
+	"keys":          permissionUse,
+	"totp":          permissionUse,
+	"":              permissionUse,
+	// pool administration
+	"admin/servers":     permissionPool,
+	"admin/audit":       permissionPool,
+	"admin/release":     permissionPool,
+	"admin/maintenance": permissionPool,
+	"admin/drain":       permissionPool,
+	"admin/priority":    permissionAccounts,
+	"admin/role":        permissionAccounts,
+}
+
+// publicRequest tells if the method of a public command request is accepted
+func publicRequest(r *http.Request, command string) bool {
+	switch command {
+	case "getToken":
+		return r.Method == http.MethodGet || r.Method == http.MethodPost
+	case "logout":
+		// The credential service only ends the session of the cookie
+		return r.Method == http.MethodPost
+	case "oidcProvider", "oidcLogin", "oidcCallback":
+		// The single sign-on is checked by the identity provider
+		return r.Method == http.MethodGet
+	}
+	return true
+}
+
+// roleAllows tells if a role has the permission a command needs
+func roleAllows(role string, command string) bool {
+	permission, ok := commandPermissions[command]
+	if !ok {
+		return false
+	}
+	if permission == permissionPublic {
+		return true
+	}
+	rank := base.RoleRank(role)
+	return rank != -1 && rank >= base.RoleRank(permissionRoles[permission])
+}
+
+// accountRole is the role of an account
+// Upercase is mandatory for JSON library parsing
+type accountRole struct {
+	Role string
+}
+
+// setAccountRole asks the credential service to change the role of a user,
+// it returns the status of the answer
+func setAccountRole(nickname string, update accountRole) (int, error) {
+	content, _ := json.Marshal(update)
+	request, _ := http.NewRequest(http.MethodPut, "http://"+credentialURI+credentialPort+"/account/"+url.PathEscape(nickname)+"/role", bytes.NewReader(content))
+	request.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("503 Can't reach credential service: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, errors.New(strings.TrimSpace(string(body)))
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,106 @@
+// OSFCI Server module - scoped API keys
+//
+// A key pair can be restricted to a few scopes and given an expiration date
+// so that a robot doesn't hold the power of the human owning the account.
+// Each command needs one scope, a scoped key can only sign the commands of
+// its scopes and a command which is not listed is refused. A robot opens a
+// session by signing getToken without password, the session cookie keeps
+// the scopes of the key and the session commands are checked against them.
+
+package main
+
+import (
+	"base/base"
+	"fmt"
+	"net/http"
+)
+
+// commandScopes is the scope each command needs from a scoped key
+var commandScopes = map[string]string{
+	// sessions and the wait queues
+	"getToken":    "session",
+	"getServer":   "session",
+	"getServers":  "session",
+	"stopServer":  "session",
+	"extendLease": "session",
+	"reservation": "session",
+	"share":       "session",
+	// firmware builds
+	"gitToken":          "build",
+	"buildbiosfirmware": "build",
+	"buildbmcfirmware":  "build",
+	// built firmware download
+	"getOpenBMC":      "firmware:read",
+	"getLinuxBoot":    "firmware:read",
+	"getOpenBMCLog":   "firmware:read",
+	"getLinuxBootLog": "firmware:read",
+	// power and emulators
+	"poweron":          "power",
+	"poweroff":         "power",
+	"startbmc":         "power",
+	"startsmbios":      "power",
+	"resetEmulator":    "power",
+	"bmcfirmware":      "power",
+	"biosfirmware":     "power",
+	"loadbuiltsmbios":  "power",
+	"loadbuiltopenbmc": "power",
+	// account
+	"userGetInfo":   "account",
+	"updateAccount": "account",
+	"updateAvatar":  "account",
+	"getAvatar":     "account",
+	"keys":          "account",
+	"totp":          "account",
+	// pool administration
+	"admin/servers":     "admin",
+	"admin/audit":       "admin",
+	"admin/release":     "admin",
+	"admin/maintenance": "admin",
+	"admin/drain":       "admin",
+	"admin/priority":    "admin",
+	"admin/role":        "admin",
+}
+
+// authorizeKey tells if a key which signed a request can run a command and
+// records its use
+func authorizeKey(r *http.Request, key accessKey, command string) bool {
+	if !keyAllows(key, command) {
+		return false
+	}
+	r.Header.Set(base.VerifiedKeyHeader, key.AccessKey)
+	go markKeyUsed(key.AccessKey)
+	return true
+}
+
+// keyAllows tells if a key can run a command, its owner must have the role
+// the command needs
+func keyAllows(key accessKey, command string) bool {
+	if key.Expired() {
+		fmt.Printf("Key %s of %s expired\n", key.Name, key.Nickname)
+		return false
+	}
+	if !roleAllows(key.Role, command) {
+		fmt.Printf("Role %q of %s can't run %s\n", key.Role, key.Nickname, command)
+		return false
+	}
+	if len(key.Scopes) > 0 {
+		scope, ok := commandScopes[command]
+		if !ok || !key.Allows(scope) {
+			fmt.Printf("Key %s of %s can't run %s\n", key.Name, key.Nickname, command)
+			return false
+		}
+	}
+	return true
+}
+
+// tokenLogin tells if a getToken request opens a session with a signed key
+// instead of a password
+func tokenLogin(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" && r.ContentLength <= 0 && r.URL.Query().Get("password") == ""
+}
+
+// sessionCommand tells if a session command needs a scope the session may not have
+func sessionCommand(command string) bool {
+	scope, ok := commandScopes[command]
+	return ok && scope != "session"
+}
@@ -0,0 +1,158 @@
+// OSFCI Server module - session cookies
+//
+// The sessions are owned by the credential service. The gateway checks each
+// osfci_cookie against it before using it and remembers the answer during
+// sessionCacheTTL, an unknown or expired cookie is handled as no cookie. A
+// logout going through the gateway is forgotten at once, a session ended
+// otherwise is seen once its check is older than sessionCacheTTL.
+
+package main
+
+import (
+	"base/base"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// sessionCacheTTL is the time a session check is trusted
+var sessionCacheTTL = 30 * time.Second
+
+// cachedSession is the answer of the credential service about a cookie, an
+// unknown cookie has no nickname
+type cachedSession struct {
+	nickname string
+	scopes   []string
+	checked  time.Time
+	// classes of the account, read by the first getServer of the session
+	classes *accountPriority
+}
+
+var sessionCache = make(map[string]cachedSession)
+var sessionCacheLock sync.Mutex
+
+// fetchSession asks the credential service the owner and the scopes of a session
+func fetchSession(cookie string) (cachedSession, bool) {
+	entry := cachedSession{checked: time.Now()}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + credentialURI + credentialPort + "/session/" + url.PathEscape(cookie))
+	if err != nil {
+		fmt.Printf("Can't reach credential service: %s\n", err)
+		return entry, false
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		return entry, true
+	}
+	resp, err = client.Get("http://" + credentialURI + credentialPort + "/session/" + url.PathEscape(cookie) + "/scopes")
+	if err != nil {
+		fmt.Printf("Can't reach credential service: %s\n", err)
+		return entry, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&entry.scopes) != nil {
+		return entry, true
+	}
+	entry.nickname = string(body)
+	return entry, true
+}
+
+// lookupSession returns the session of a cookie, from the cache while its
+// check is recent enough
+func lookupSession(cookie string) cachedSession {
+	sessionCacheLock.Lock()
+	entry, ok := sessionCache[cookie]
+	sessionCacheLock.Unlock()
+	if ok && time.Since(entry.checked) < sessionCacheTTL {
+		return entry
+	}
+	entry, ok = fetchSession(cookie)
+	if !ok {
+		// The answer is not cached as the credential service may be back soon
+		return entry
+	}
+	sessionCacheLock.Lock()
+	defer sessionCacheLock.Unlock()
+	for key, cached := range sessionCache {
+		if time.Since(cached.checked) >= sessionCacheTTL {
+			delete(sessionCache, key)
+		}
+	}
+	sessionCache[cookie] = entry
+	return entry
+}
+
+// forgetSession drops a cookie from the cache
+func forgetSession(cookie string) {
+	sessionCacheLock.Lock()
+	defer sessionCacheLock.Unlock()
+	delete(sessionCache, cookie)
+}
+
+// sessionClasses returns the priority classes of the owner of a session, the
+// credential service is asked once per session check
+func sessionClasses(cookie string, nickname string) (accountPriority, bool) {
+	if entry := lookupSession(cookie); entry.nickname == nickname && entry.classes != nil {
+		return *entry.classes, true
+	}
+	account, ok := getAccount(nickname)
+	if !ok {
+		return accountPriority{}, false
+	}
+	classes := accountPriority{account.Priority, account.TokenPriority}
+	sessionCacheLock.Lock()
+	defer sessionCacheLock.Unlock()
+	if entry, ok := sessionCache[cookie]; ok && entry.nickname == nickname {
+		entry.classes = &classes
+		sessionCache[cookie] = entry
+	}
+	return classes, true
+}
+
+// forgetClasses drops the priority classes cached for the sessions of a user
+func forgetClasses(nickname string) {
+	sessionCacheLock.Lock()
+	defer sessionCacheLock.Unlock()
+	for cookie, entry := range sessionCache {
+		if entry.nickname == nickname {
+			entry.classes = nil
+			sessionCache[cookie] = entry
+		}
+	}
+}
+
+// cookieOwner returns the nickname of a session owner, empty if the session
+// is unknown or expired
+func cookieOwner(cookie string) string {
+	if cookie == "" {
+		return ""
+	}
+	return lookupSession(cookie).nickname
+}
+
+// sessionCookie returns the osfci_cookie of a request if its session is active
+func sessionCookie(r *http.Request) (*http.Cookie, error) {
+	cookie, err := r.Cookie("osfci_cookie")
+	if err != nil {
+		return nil, err
+	}
+	if cookieOwner(cookie.Value) == "" {
+		return nil, http.ErrNoCookie
+	}
+	return cookie, nil
+}
+
+// sessionAllows tells if the session of a cookie can run a command, sessions
+// opened with a password have every scope
+func sessionAllows(cookie string, command string) bool {
+	entry := lookupSession(cookie)
+	if entry.nickname == "" {
+		return false
+	}
+	return base.APIKey{Scopes: entry.scopes}.Allows(commandScopes[command])
+}
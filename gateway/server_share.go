@@ -0,0 +1,468 @@
+// OSFCI Server module - shared sessions
+//
+// The owner of a session can invite other registered users onto its
+// servers. A guest with read access can watch the consoles and the BMC web
+// interface, its keyboard input is dropped. A guest with full access can
+// also drive the power, the emulators and the firmware endpoints. Only the
+// owner can extend, stop or share the session. Every session command is
+// recorded into the audit trail with the nickname of the user who ran it.
+//   GET    /ci/share/<login>                        guests and audit of our session
+//   GET    /ci/share/<login>/invitations            sessions shared with us
+//   PUT    /ci/share/<login>/<nickname>/<read|full> invite a user
+//   DELETE /ci/share/<login>/<nickname>             revoke a user
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sessionAccess is what a cookie is allowed to do on a server
+type sessionAccess string
+
+const (
+	accessNone  sessionAccess = ""
+	accessRead  sessionAccess = "read"
+	accessFull  sessionAccess = "full"
+	accessOwner sessionAccess = "owner"
+)
+
+// sessionRole is the access of a cookie to a server and the user behind it
+type sessionRole struct {
+	access   sessionAccess
+	nickname string
+}
+
+// sessionGuest is a user invited onto a session
+// Upercase is mandatory for JSON library parsing
+type sessionGuest struct {
+	Nickname  string
+	Access    sessionAccess
+	InvitedBy string
+	Invited   time.Time
+}
+
+// auditEvent records who did what on a server
+// Upercase is mandatory for JSON library parsing
+type auditEvent struct {
+	Time       time.Time
+	Servername string
+	Nickname   string
+	Access     sessionAccess
+	Action     string
+}
+
+// auditTrail is owned by the pool goroutine, the oldest events are dropped
+var auditTrail []auditEvent
+
+// maxAuditEvents is the number of events kept into the audit trail
+var maxAuditEvents = 2000
+
+// readCommands are the commands a read only guest can run
+var readCommands = map[string]bool{
+	"console":            true,
+	"smbiosconsole":      true,
+	"bmcconsole":         true,
+	"osloaderconsole":    true,
+	"smbiosbuildconsole": true,
+	"bmcbuildconsole":    true,
+	"bmcup":              true,
+	"isRunning":          true,
+	"isEmulatorsPool":    true,
+	"events":             true,
+}
+
+// ownerCommands are the commands only the owner of a session can run
+var ownerCommands = map[string]bool{
+	"extendLease": true,
+	"gitToken":    true,
+}
+
+// auditedCommands are the session commands recorded into the audit trail,
+// consoles are recorded when they are opened
+var auditedCommands = map[string]bool{
+	"poweron":           true,
+	"poweroff":          true,
+	"startbmc":          true,
+	"startsmbios":       true,
+	"resetEmulator":     true,
+	"bmcfirmware":       true,
+	"biosfirmware":      true,
+	"buildbiosfirmware": true,
+	"buildbmcfirmware":  true,
+	"loadbuiltsmbios":   true,
+	"loadbuiltopenbmc":  true,
+	"getosinstallers":   true,
+	"extendLease":       true,
+	"gitToken":          true,
+}
+
+// commandAllowed tells if a role can run a session command
+func commandAllowed(command string, access sessionAccess) bool {
+	switch access {
+	case accessOwner:
+		return true
+	case accessFull:
+		return !ownerCommands[command]
+	case accessRead:
+		return readCommands[command]
+	}
+	return false
+}
+
+// recordAudit adds an event to the audit trail
+// must be called from the pool goroutine
+func recordAudit(servername string, role sessionRole, action string) {
+	fmt.Printf("Audit %s: %s (%s) %s\n", servername, role.nickname, role.access, action)
+	auditTrail = append(auditTrail, auditEvent{time.Now(), servername, role.nickname, role.access, action})
+	if len(auditTrail) > maxAuditEvents {
+		auditTrail = append([]auditEvent(nil), auditTrail[len(auditTrail)-maxAuditEvents:]...)
+	}
+	savePoolState()
+}
+
+// auditCommand records a session command if it changes the server
+func auditCommand(r *http.Request, command string, servername string, role sessionRole) {
+	opened := readCommands[command] && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	if !auditedCommands[command] && !opened {
+		return
+	}
+	action := command
+	if opened {
+		action = "open " + command
+	}
+	withPool(func() {
+		recordAudit(servername, role, action)
+	})
+}
+
+// serverAudit returns the events of a server since a date
+// must be called from the pool goroutine
+func serverAudit(servername string, since time.Time) []auditEvent {
+	var events []auditEvent
+	for _, event := range auditTrail {
+		if (servername == "" || event.Servername == servername) && !event.Time.Before(since) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// guestAccess returns the access of a user invited onto a server
+// must be called from the pool goroutine
+func guestAccess(index int, nickname string) sessionAccess {
+	for _, guest := range ciServers.servers[index].guests {
+		if guest.Nickname == nickname {
+			return guest.Access
+		}
+	}
+	return accessNone
+}
+
+// sharedServers tells if a session has guests, the nickname of a cookie is
+// only asked to the credential service when it can be one of them
+// must be called from the pool goroutine
+func sharedServers() bool {
+	for i := range ciServers.servers {
+		if ciServers.servers[i].state == serverAllocated && len(ciServers.servers[i].guests) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// inviteGuest gives a user access to a server and the other servers of its group
+// must be called from the pool goroutine
+func inviteGuest(index int, guest sessionGuest) {
+	for _, i := range leaseMembers(index) {
+		entry := &ciServers.servers[i]
+		var guests []sessionGuest
+		for _, current := range entry.guests {
+			if current.Nickname != guest.Nickname {
+				guests = append(guests, current)
+			}
+		}
+		entry.guests = append(guests, guest)
+		recordAudit(entry.servername, sessionRole{accessOwner, guest.InvitedBy}, "invite "+guest.Nickname+" "+string(guest.Access))
+	}
+}
+
+// revokeGuest removes the access of a user to a server and to its group
+// must be called from the pool goroutine
+func revokeGuest(index int, nickname string, by string) bool {
+	found := false
+	for _, i := range leaseMembers(index) {
+		entry := &ciServers.servers[i]
+		var guests []sessionGuest
+		for _, current := range entry.guests {
+			if current.Nickname == nickname {
+				found = true
+				continue
+			}
+			guests = append(guests, current)
+		}
+		entry.guests = guests
+		if found {
+			recordAudit(entry.servername, sessionRole{accessOwner, by}, "revoke "+nickname)
+		}
+	}
+	return found
+}
+
+// shareCommand serves the session sharing requests
+// path is /share/<login>[/<nickname>[/<access>]]
+func shareCommand(w http.ResponseWriter, r *http.Request, tail string, cookie string) {
+	keys := strings.Split(tail, "/")
+	if len(keys) < 3 {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	command := keys[1]
+	login := keys[2]
+	if !checkAccess(w, r, login, command) || cookieOwner(cookie) != login {
+		http.Error(w, "403 Access denied", 403)
+		return
+	}
+	target := ""
+	if len(keys) > 3 {
+		target = keys[3]
+	}
+
+	// Upercase is mandatory for JSON library parsing
+	type invitation struct {
+		Servername string
+		Owner      string
+		Access     sessionAccess
+		Expiration time.Time
+	}
+	if target == "invitations" && r.Method == http.MethodGet {
+		var invitations []invitation
+		withPool(func() {
+			for i := range ciServers.servers {
+				entry := ciServers.servers[i]
+				if entry.state != serverAllocated || time.Now().After(entry.expiration) {
+					continue
+				}
+				if access := guestAccess(i, login); access != accessNone {
+					invitations = append(invitations, invitation{entry.servername, entry.ownerNickname, access, entry.expiration})
+				}
+			}
+		})
+		returnData, _ := json.Marshal(invitations)
+		w.Write(returnData)
+		return
+	}
+
+	type returnValue struct {
+		Servername string
+		Guests     []sessionGuest
+		Audit      []auditEvent
+	}
+	var myoutput returnValue
+	var err error
+	status := 409
+	if target != "" && r.Method == http.MethodPut {
+		// The guest must be a registered user
+		access := sessionAccess("")
+		if len(keys) > 4 {
+			access = sessionAccess(keys[4])
+		}
+		if access != accessRead && access != accessFull {
+			http.Error(w, "401 Access must be read or full", 401)
+			return
+		}
+		if target == login {
+			http.Error(w, "409 You already own that session", 409)
+			return
+		}
+		if _, ok := getAccount(target); !ok {
+			http.Error(w, "404 Unknown user", 404)
+			return
+		}
+		withPool(func() {
+			index := sessionIndex(cookie)
+			if index == -1 {
+				err = fmt.Errorf("no active server")
+				status = 404
+				return
+			}
+			inviteGuest(index, sessionGuest{target, access, login, time.Now()})
+		})
+	} else if target != "" && r.Method == http.MethodDelete {
+		withPool(func() {
+			index := sessionIndex(cookie)
+			if index == -1 {
+				err = fmt.Errorf("no active server")
+				status = 404
+				return
+			}
+			if !revokeGuest(index, target, login) {
+				err = fmt.Errorf("%s is not invited", target)
+				status = 404
+			}
+		})
+	} else if target != "" || r.Method != http.MethodGet {
+		http.Error(w, "401 Unknown share command", 401)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%d %s", status, err.Error()), status)
+		return
+	}
+	withPool(func() {
+		index := sessionIndex(cookie)
+		if index == -1 {
+			err = fmt.Errorf("no active server")
+			return
+		}
+		entry := ciServers.servers[index]
+		myoutput.Servername = entry.servername
+		myoutput.Guests = append([]sessionGuest(nil), entry.guests...)
+		myoutput.Audit = serverAudit(entry.servername, entry.leaseStart)
+	})
+	if err != nil {
+		http.Error(w, "404 "+err.Error(), 404)
+		return
+	}
+	returnData, _ := json.Marshal(myoutput)
+	w.Write(returnData)
+}
+
+// sessionIndex returns the server leased to a cookie, -1 if there is none
+// must be called from the pool goroutine
+func sessionIndex(cookie string) int {
+	for i := range ciServers.servers {
+		entry := ciServers.servers[i]
+		if entry.state == serverAllocated && entry.currentOwner == cookie && time.Now().Before(entry.expiration) {
+			return i
+		}
+	}
+	return -1
+}
+
+// serveConsole relays a console, the keyboard of read only guests is ignored
+func serveConsole(w http.ResponseWriter, r *http.Request, proxy *httputil.ReverseProxy, target *url.URL, access sessionAccess) {
+	if access != accessRead || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	readOnlyWebsocket(w, r, target.Host)
+}
+
+// readOnlyWebsocket relays a ttyd websocket dropping the input messages of the
+// client, the terminal output still reaches it
+func readOnlyWebsocket(w http.ResponseWriter, r *http.Request, host string) {
+	backend, err := net.DialTimeout("tcp", host, probeTimeout)
+	if err != nil {
+		http.Error(w, "502 Console is unreachable", 502)
+		return
+	}
+	defer backend.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 Console can't be relayed", 500)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	if r.Write(backend) != nil {
+		return
+	}
+	go func() {
+		io.Copy(client, backend)
+		client.Close()
+	}()
+	relayReadOnlyFrames(backend, buffered.Reader)
+}
+
+// ttydInput is the first byte of a ttyd message carrying keyboard input
+const ttydInput = '0'
+
+// maxFrameLength is the largest websocket frame relayed to a console
+const maxFrameLength = 1 << 20
+
+// relayReadOnlyFrames copies the websocket frames of a client dropping the
+// ttyd input messages and their continuation frames
+func relayReadOnlyFrames(dst io.Writer, src *bufio.Reader) {
+	dropping := false
+	for {
+		frame := make([]byte, 2)
+		if _, err := io.ReadFull(src, frame); err != nil {
+			return
+		}
+		length := uint64(frame[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(src, extended); err != nil {
+				return
+			}
+			frame = append(frame, extended...)
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err := io.ReadFull(src, extended); err != nil {
+				return
+			}
+			frame = append(frame, extended...)
+			length = binary.BigEndian.Uint64(extended)
+		}
+		var mask []byte
+		if frame[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(src, mask); err != nil {
+				return
+			}
+			frame = append(frame, mask...)
+		}
+		if length > maxFrameLength {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return
+		}
+		final := frame[0]&0x80 != 0
+		opcode := frame[0] & 0x0f
+		switch opcode {
+		case 1, 2:
+			first := byte(0)
+			if length > 0 {
+				first = payload[0]
+				if mask != nil {
+					first ^= mask[0]
+				}
+			}
+			dropping = first == ttydInput
+		case 0:
+			// continuation of the previous message
+		default:
+			// control frames are always relayed
+			if _, err := dst.Write(append(frame, payload...)); err != nil {
+				return
+			}
+			continue
+		}
+		if !dropping {
+			if _, err := dst.Write(append(frame, payload...)); err != nil {
+				return
+			}
+		}
+		if final {
+			dropping = false
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// OSFCI Server module - v2 request signatures
+//
+// The v1 "OSF" signature is an HMAC-SHA1 of the method, content type, date
+// and path. It doesn't cover the body and its date is never checked so a
+// captured request can be replayed. A v2 request is signed with
+//   Authorization: OSF2 <accessKey>:<signature>
+//   myDate: <RFC1123Z date>
+//   X-Osf-Nonce: <single use value>
+// where the signature is the base64 HMAC-SHA256 of base.StringToSignV2: the
+// method, path, canonical query, content type, date, nonce and the SHA-256
+// of the body. The date must be within signatureSkew of ours and a nonce is
+// accepted once.
+
+package main
+
+import (
+	"base/base"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureSkew is the largest difference between the date of a signed request and ours
+var signatureSkew = 5 * time.Minute
+
+// signatureV1 accepts the HMAC-SHA1 signatures of the older clients
+var signatureV1 = true
+
+// nonces are the nonces seen within the date window and when they can be forgotten
+var nonces = make(map[string]time.Time)
+var noncesLock sync.Mutex
+
+// parseSignatureDate reads the date of a signed request
+func parseSignatureDate(myDate string) (time.Time, error) {
+	date, err := time.Parse(time.RFC1123Z, myDate)
+	if err != nil {
+		date, err = time.Parse(time.RFC1123, myDate)
+	}
+	return date, err
+}
+
+// useNonce records a nonce, it returns false if the nonce was already used
+func useNonce(login string, nonce string, forget time.Time) bool {
+	noncesLock.Lock()
+	defer noncesLock.Unlock()
+	for key, expiration := range nonces {
+		if time.Now().After(expiration) {
+			delete(nonces, key)
+		}
+	}
+	key := login + "/" + nonce
+	if _, ok := nonces[key]; ok {
+		return false
+	}
+	nonces[key] = forget
+	return true
+}
+
+// signingKey returns the key of login which signed a request. It has no side
+// effect: the nonce of a v2 request is not used up so it doesn't authenticate
+// the request, checkAccess does
+func signingKey(r *http.Request, login string) (accessKey, bool) {
+	words := strings.Fields(r.Header.Get("Authorization"))
+	if len(words) != 2 {
+		return accessKey{}, false
+	}
+	if words[0] == base.SignatureV2 {
+		return verifySignatureV2(r, login, words[1])
+	}
+	if words[0] == "OSF" && signatureV1 {
+		return verifySignatureV1(r, login, words[1])
+	}
+	return accessKey{}, false
+}
+
+// verifySignatureV1 validates the OSF credential of a request signed by login
+// and returns the key which signed it
+func verifySignatureV1(r *http.Request, login string, credential string) (accessKey, bool) {
+	// We must retrieve the secret key used for encryption and calculate the header
+	// if everything is ok (aka our computed value match) we are good
+	// the key must belong to the login
+	keys := strings.Split(credential, ":")
+	if len(keys) != 2 {
+		return accessKey{}, false
+	}
+	key, ok := lookupKey(keys[0], login)
+	if !ok {
+		return key, false
+	}
+	stringToSign := r.Method + "\n\n" + r.Header.Get("Content-Type") + "\n" + r.Header.Get("myDate") + "\n" + r.URL.Path
+	mac := hmac.New(sha1.New, []byte(key.SecretKey))
+	mac.Write([]byte(stringToSign))
+	return key, base64.StdEncoding.EncodeToString(mac.Sum(nil)) == keys[1]
+}
+
+// verifySignatureV2 validates the OSF2 credential of a request signed by login
+// and returns the key which signed it, the nonce is not used up
+func verifySignatureV2(r *http.Request, login string, credential string) (accessKey, bool) {
+	var key accessKey
+	keys := strings.SplitN(credential, ":", 2)
+	if len(keys) != 2 {
+		return key, false
+	}
+	myDate := r.Header.Get("myDate")
+	date, err := parseSignatureDate(myDate)
+	if err != nil {
+		return key, false
+	}
+	if skew := time.Since(date); skew > signatureSkew || skew < -signatureSkew {
+		fmt.Printf("Signed request from %s is dated %s\n", login, myDate)
+		return key, false
+	}
+	nonce := r.Header.Get(base.NonceHeader)
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return key, false
+	}
+	key, ok := lookupKey(keys[0], login)
+	if !ok {
+		return key, false
+	}
+	content := base.HTTPGetBody(r)
+	stringToSign := base.StringToSignV2(r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"), myDate, nonce, content)
+	expectedMAC := base.ComputeSignatureV2(key.SecretKey, stringToSign)
+	return key, hmac.Equal([]byte(expectedMAC), []byte(keys[1]))
+}
+
+// useSignatureNonce uses up the nonce of a valid v2 request, it returns false
+// if the request is replayed
+func useSignatureNonce(r *http.Request, login string) bool {
+	// Only a valid signature uses up its nonce, the date check rejects the
+	// request once the nonce is forgotten
+	date, err := parseSignatureDate(r.Header.Get("myDate"))
+	if err != nil || !useNonce(login, r.Header.Get(base.NonceHeader), date.Add(signatureSkew)) {
+		fmt.Printf("Replayed request from %s\n", login)
+		return false
+	}
+	return true
+}
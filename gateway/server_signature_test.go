@@ -0,0 +1,157 @@
+package main
+
+import (
+	"base/base"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCredentialService answers the key lookups of the gateway for the key
+// AK of alice, it is shared by the tests as the key uses are recorded in the
+// background
+var fakeCredentialService sync.Once
+
+func startCredentialService() {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/key/AK" {
+			return
+		}
+		var key accessKey
+		key.Nickname = r.URL.Query().Get("login")
+		key.Role = base.RoleUser
+		key.AccessKey = "AK"
+		key.SecretKey = "SK"
+		if key.Nickname != "alice" {
+			http.Error(w, "404 Unknown key", 404)
+			return
+		}
+		json.NewEncoder(w).Encode(key)
+	}))
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(service.URL, "http://"))
+	credentialURI = host
+	credentialPort = ":" + port
+}
+
+// signedRequest returns a request of alice signed with the v2 scheme at date
+func signedRequest(method string, content []byte, secret string, date time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest(method, "/user/alice/userGetInfo?b=2&a=1", bytes.NewReader(content))
+	r.Header.Set("Content-Type", "application/json")
+	myDate := strings.Replace(date.UTC().Format(http.TimeFormat), "GMT", "+0000", -1)
+	r.Header.Set("myDate", myDate)
+	r.Header.Set(base.NonceHeader, nonce)
+	stringToSign := base.StringToSignV2(method, r.URL.Path, r.URL.RawQuery, "application/json", myDate, nonce, content)
+	r.Header.Set("Authorization", base.SignatureV2+" AK:"+base.ComputeSignatureV2(secret, stringToSign))
+	return r
+}
+
+func TestUseNonce(t *testing.T) {
+	forget := time.Now().Add(time.Minute)
+	if !useNonce("alice", "nonce-use-0123456", forget) {
+		t.Fatalf("a new nonce is refused")
+	}
+	if useNonce("alice", "nonce-use-0123456", forget) {
+		t.Errorf("a nonce is accepted twice")
+	}
+	if !useNonce("bob", "nonce-use-0123456", forget) {
+		t.Errorf("the nonce of alice is refused to bob")
+	}
+	// Once forgotten the date check refuses the request
+	if !useNonce("alice", "nonce-old-0123456", time.Now().Add(-time.Second)) {
+		t.Fatalf("a new nonce is refused")
+	}
+	if !useNonce("alice", "nonce-old-0123456", forget) {
+		t.Errorf("a forgotten nonce is still known")
+	}
+}
+
+func TestCheckSignatureV2(t *testing.T) {
+	fakeCredentialService.Do(startCredentialService)
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    bool
+	}{
+		{"valid", func() *http.Request {
+			return signedRequest("GET", nil, "SK", time.Now(), "nonce-valid-0123")
+		}, true},
+		{"wrong secret", func() *http.Request {
+			return signedRequest("GET", nil, "XX", time.Now(), "nonce-secret-012")
+		}, false},
+		{"skew in the past", func() *http.Request {
+			return signedRequest("GET", nil, "SK", time.Now().Add(-signatureSkew-time.Minute), "nonce-past-01234")
+		}, false},
+		{"skew in the future", func() *http.Request {
+			return signedRequest("GET", nil, "SK", time.Now().Add(signatureSkew+time.Minute), "nonce-future-012")
+		}, false},
+		{"within the skew", func() *http.Request {
+			return signedRequest("GET", nil, "SK", time.Now().Add(-signatureSkew+time.Minute), "nonce-within-012")
+		}, true},
+		{"short nonce", func() *http.Request {
+			return signedRequest("GET", nil, "SK", time.Now(), "short")
+		}, false},
+		{"body swapped", func() *http.Request {
+			r := signedRequest("PUT", []byte("{}"), "SK", time.Now(), "nonce-body-01234")
+			r.Body = httptest.NewRequest("PUT", "/", strings.NewReader(`{"Role":"admin"}`)).Body
+			return r
+		}, false},
+		{"query changed", func() *http.Request {
+			r := signedRequest("GET", nil, "SK", time.Now(), "nonce-query-0123")
+			r.URL.RawQuery = "a=1&b=3"
+			return r
+		}, false},
+		{"query reordered", func() *http.Request {
+			r := signedRequest("GET", nil, "SK", time.Now(), "nonce-order-0123")
+			r.URL.RawQuery = "a=1&b=2"
+			return r
+		}, true},
+		{"key of another user", func() *http.Request {
+			r := signedRequest("GET", nil, "SK", time.Now(), "nonce-login-0123")
+			r.URL.Path = "/user/bob/userGetInfo"
+			return r
+		}, false},
+	}
+	for _, test := range tests {
+		r := test.request()
+		login := strings.Split(r.URL.Path, "/")[2]
+		if got := checkAccess(httptest.NewRecorder(), r, login, "userGetInfo"); got != test.want {
+			t.Errorf("%s: checkAccess = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckSignatureV2Replay(t *testing.T) {
+	fakeCredentialService.Do(startCredentialService)
+	first := signedRequest("GET", nil, "SK", time.Now(), "nonce-replay-012")
+	replay := first.Clone(first.Context())
+	if !checkAccess(httptest.NewRecorder(), first, "alice", "userGetInfo") {
+		t.Fatalf("the first request is refused")
+	}
+	if first.Header.Get(base.VerifiedKeyHeader) != "AK" {
+		t.Errorf("the key of the first request is not verified")
+	}
+	if checkAccess(httptest.NewRecorder(), replay, "alice", "userGetInfo") {
+		t.Errorf("the replayed request is accepted")
+	}
+}
+
+func TestSigningKeyKeepsNonce(t *testing.T) {
+	fakeCredentialService.Do(startCredentialService)
+	r := signedRequest("GET", nil, "SK", time.Now(), "nonce-signing-01")
+	// Picking the priority class doesn't use up the nonce
+	if key, ok := signingKey(r, "alice"); !ok || key.AccessKey != "AK" {
+		t.Fatalf("signingKey = %s, %t", key.AccessKey, ok)
+	}
+	if r.Header.Get(base.VerifiedKeyHeader) != "" {
+		t.Errorf("signingKey verified the key")
+	}
+	if !checkAccess(httptest.NewRecorder(), r, "alice", "userGetInfo") {
+		t.Errorf("the request is refused once its key was looked up")
+	}
+}
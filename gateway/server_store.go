@@ -0,0 +1,407 @@
+// OSFCI Server module - server pool persistence
+//
+// The gateway keeps track of the servers allocation into ciServers. That
+// state is pushed to the storage backend each time it changes as to be
+// reloaded when the gateway restarts.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serverState is the durable part of a serverEntry, the git token of a lease
+// is never written so its user gives it again after a restart. The session
+// cookies are written as their digest
+// Upercase is mandatory for JSON library parsing
+type serverState struct {
+	Servername   string
+	CurrentOwner string
+	Nickname     string
+	Expiration   time.Time
+	LeaseStart   time.Time
+	Extensions   int
+	State        serverLifecycle
+	Transitions  []serverTransition
+	Drain        bool
+	Priority     string
+	Preempted    bool
+	Group        string
+	Guests       []sessionGuest
+	// Registered controllers must be known before they come back
+	Dynamic   bool
+	IP        string
+	TCPPort   string
+	CompileIP string
+	BMCIP     string
+	Product   string
+	Labels    map[string]string
+}
+
+// poolSnapshot is what is written to the storage backend
+type poolSnapshot struct {
+	servers      []serverState
+	tickets      []queueTicket
+	reservations []reservation
+	usages       []userUsage
+	audit        []auditEvent
+}
+
+// Only the latest snapshot needs to reach the storage backend
+var poolStateUpdates = make(chan poolSnapshot, 1)
+
+// getPoolDocument retrieves a document stored by the gateway into the storage backend
+func getPoolDocument(name string) ([]byte, error) {
+	resp, err := http.Get("http://" + StorageURI + StorageTCPPORT + "/pool/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage backend returned %s", resp.Status)
+	}
+	if string(body) == "Error" {
+		return nil, nil
+	}
+	return body, nil
+}
+
+// putPoolDocument stores a gateway document into the storage backend
+func putPoolDocument(name string, content []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("PUT", "http://"+StorageURI+StorageTCPPORT+"/pool/"+name, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage backend returned %s", resp.Status)
+	}
+	return nil
+}
+
+// savePoolState schedules a write of the pool state
+// must be called from the pool goroutine
+func savePoolState() {
+	var snapshot poolSnapshot
+	snapshot.servers = make([]serverState, len(ciServers.servers))
+	for i := range ciServers.servers {
+		snapshot.servers[i].Servername = ciServers.servers[i].servername
+		snapshot.servers[i].CurrentOwner = ownerDigest(ciServers.servers[i].currentOwner)
+		snapshot.servers[i].Nickname = ciServers.servers[i].ownerNickname
+		snapshot.servers[i].Expiration = ciServers.servers[i].expiration
+		snapshot.servers[i].LeaseStart = ciServers.servers[i].leaseStart
+		snapshot.servers[i].Extensions = ciServers.servers[i].extensions
+		snapshot.servers[i].State = ciServers.servers[i].state
+		snapshot.servers[i].Transitions = append([]serverTransition(nil), ciServers.servers[i].transitions...)
+		snapshot.servers[i].Drain = ciServers.servers[i].drain
+		snapshot.servers[i].Priority = ciServers.servers[i].priority
+		snapshot.servers[i].Preempted = ciServers.servers[i].preempted
+		snapshot.servers[i].Group = ciServers.servers[i].group
+		snapshot.servers[i].Guests = append([]sessionGuest(nil), ciServers.servers[i].guests...)
+		if ciServers.servers[i].dynamic && !ciServers.servers[i].retired {
+			snapshot.servers[i].Dynamic = true
+			snapshot.servers[i].IP = ciServers.servers[i].ip
+			snapshot.servers[i].TCPPort = ciServers.servers[i].tcpPort
+			snapshot.servers[i].CompileIP = ciServers.servers[i].compileIP
+			snapshot.servers[i].BMCIP = ciServers.servers[i].bmcIP
+			snapshot.servers[i].Product = ciServersProducts[ciServers.servers[i].ProductIndex].Product
+			snapshot.servers[i].Labels = ciServers.servers[i].labels
+		}
+	}
+	snapshot.tickets = queueSnapshot()
+	for i := range snapshot.tickets {
+		snapshot.tickets[i].Owner = ownerDigest(snapshot.tickets[i].Owner)
+	}
+	snapshot.reservations = append([]reservation(nil), reservations...)
+	for i := range snapshot.reservations {
+		snapshot.reservations[i].Cookie = ownerDigest(snapshot.reservations[i].Cookie)
+	}
+	snapshot.usages = usageSnapshot()
+	snapshot.audit = append([]auditEvent(nil), auditTrail...)
+	// If the writer didn't pick up the previous snapshot yet
+	// we replace it by the new one
+	select {
+	case <-poolStateUpdates:
+	default:
+	}
+	poolStateUpdates <- snapshot
+}
+
+// poolStateWriter is the only go routine writing the pool state
+func poolStateWriter() {
+	for snapshot := range poolStateUpdates {
+		servers, _ := json.Marshal(snapshot.servers)
+		tickets, _ := json.Marshal(snapshot.tickets)
+		bookings, _ := json.Marshal(snapshot.reservations)
+		usage, _ := json.Marshal(snapshot.usages)
+		audit, _ := json.Marshal(snapshot.audit)
+		writePoolDocument("servers", servers)
+		writePoolDocument("queues", tickets)
+		writePoolDocument("reservations", bookings)
+		writePoolDocument("usage", usage)
+		writePoolDocument("audit", audit)
+	}
+}
+
+// writePoolDocument retries for a while before giving up on a write
+func writePoolDocument(name string, content []byte) {
+	for retry := 0; ; retry++ {
+		err := putPoolDocument(name, content)
+		if err == nil {
+			return
+		}
+		fmt.Printf("Can't save pool %s: %s\n", name, err)
+		if retry == 5 {
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// restorePoolState restores the pool state then starts writing it. The
+// gateway starts with an empty pool while the storage backend can't be
+// reached, the state is not written until it is restored as to not overwrite it
+func restorePoolState() {
+	for {
+		err := loadPoolState()
+		if err == nil {
+			break
+		}
+		fmt.Printf("Can't restore pool state, retrying: %s\n", err)
+		time.Sleep(30 * time.Second)
+	}
+	poolStateWriter()
+}
+
+// loadPoolState restores the pool allocation saved before the gateway stopped
+// Leases which expired while we were down are left to the reaper, what was
+// allocated or booked since we started is kept
+func loadPoolState() error {
+	var content []byte
+	var err error
+	// The storage backend is started at the same time than we are
+	// so we give it some time to come up
+	for retry := 0; retry < 10; retry++ {
+		content, err = getPoolDocument("servers")
+		if err == nil {
+			break
+		}
+		fmt.Printf("Waiting for storage backend: %s\n", err)
+		time.Sleep(3 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		fmt.Printf("No pool state to restore\n")
+		return nil
+	}
+	var states []serverState
+	err = json.Unmarshal(content, &states)
+	if err != nil {
+		fmt.Printf("Pool state is corrupted, ignoring it: %s\n", err)
+		return nil
+	}
+
+	// Registered controllers are given some time to send their heartbeats
+	for _, state := range states {
+		if !state.Dynamic {
+			continue
+		}
+		var registration controllerRegistration
+		registration.Servername = state.Servername
+		registration.IP = state.IP
+		registration.TCPPort = state.TCPPort
+		registration.CompileIP = state.CompileIP
+		registration.BMCIP = state.BMCIP
+		registration.Product = state.Product
+		registration.Labels = state.Labels
+		err = registerController(registration)
+		if err != nil {
+			fmt.Printf("Can't restore controller %s: %s\n", state.Servername, err)
+		}
+	}
+
+	// Wait queues, bookings, usages and the audit trail are restored together with the servers
+	var tickets []queueTicket
+	content, err = getPoolDocument("queues")
+	if err == nil && content != nil {
+		if json.Unmarshal(content, &tickets) != nil {
+			tickets = nil
+		}
+	}
+	var bookings []reservation
+	content, err = getPoolDocument("reservations")
+	if err == nil && content != nil {
+		_ = json.Unmarshal(content, &bookings)
+	}
+	var usage []userUsage
+	content, err = getPoolDocument("usage")
+	if err == nil && content != nil {
+		_ = json.Unmarshal(content, &usage)
+	}
+	var audit []auditEvent
+	content, err = getPoolDocument("audit")
+	if err == nil && content != nil {
+		_ = json.Unmarshal(content, &audit)
+	}
+	withPool(func() {
+		restoreServers(states)
+		for i := range tickets {
+			tickets[i].Owner = ownerDigest(tickets[i].Owner)
+		}
+		restoreQueues(tickets)
+		for i := range bookings {
+			bookings[i].Cookie = ownerDigest(bookings[i].Cookie)
+		}
+		reservations = append(bookings, reservations...)
+		ownersRestored = true
+		pruneReservations()
+		restoreUsages(usage)
+		auditTrail = append(audit, auditTrail...)
+		savePoolState()
+	})
+	return nil
+}
+
+// restoreServers applies the saved states to the pool
+// must be called from the pool goroutine
+func restoreServers(states []serverState) {
+	for _, state := range states {
+		for i := range ciServers.servers {
+			if ciServers.servers[i].servername != state.Servername || ciServers.servers[i].currentOwner != "" {
+				continue
+			}
+			entry := &ciServers.servers[i]
+			entry.drain = state.Drain
+			entry.transitions = validTransitions(state.Transitions)
+			if state.State == "" {
+				// Saved before servers had a lifecycle
+				state.State = serverFree
+				if state.CurrentOwner != "" {
+					state.State = serverAllocated
+				}
+			}
+			_, known := serverTransitions[state.State]
+			switch {
+			case !known || (state.State == serverAllocated) != (state.CurrentOwner != ""):
+				// The SUT may be in any state, the reaper resets it
+				restoreCleanup(i, fmt.Sprintf("restored from an inconsistent %q state", state.State))
+				continue
+			case state.State == serverCleaning:
+				// A cleanup which didn't complete must be done again
+				restoreCleanup(i, "cleanup interrupted by a restart")
+				continue
+			}
+			entry.state = state.State
+			if state.CurrentOwner == "" {
+				continue
+			}
+			if time.Now().After(state.Expiration) {
+				// The SUT might still be powered and its emulators running
+				// the reaper will clean it up
+				fmt.Printf("Lease of %s expired while the gateway was down\n", state.Servername)
+			} else {
+				fmt.Printf("Restoring lease of %s until %s\n", state.Servername, state.Expiration.Format(time.RFC1123Z))
+			}
+			// The session takes its lease back with its next request
+			entry.currentOwner = ownerDigest(state.CurrentOwner)
+			entry.ownerNickname = state.Nickname
+			entry.expiration = state.Expiration
+			entry.leaseStart = state.LeaseStart
+			entry.extensions = state.Extensions
+			entry.priority = state.Priority
+			entry.preempted = state.Preempted
+			entry.group = state.Group
+			entry.guests = state.Guests
+		}
+	}
+}
+
+// validTransitions keeps the saved transitions the lifecycle allows
+func validTransitions(transitions []serverTransition) []serverTransition {
+	var valid []serverTransition
+	for _, transition := range transitions {
+		for _, next := range serverTransitions[transition.From] {
+			if next == transition.To {
+				valid = append(valid, transition)
+			}
+		}
+	}
+	if len(valid) > maxTransitions {
+		valid = valid[len(valid)-maxTransitions:]
+	}
+	return valid
+}
+
+// restoreCleanup hands a restored server to the reaper
+// must be called from the pool goroutine
+func restoreCleanup(index int, reason string) {
+	entry := &ciServers.servers[index]
+	fmt.Printf("Server %s: %s\n", entry.servername, reason)
+	entry.transitions = append(entry.transitions, serverTransition{Time: time.Now(), From: entry.state, To: serverCleaning, Reason: reason})
+	entry.state = serverCleaning
+	entry.cleanupFails = 0
+	entry.cleanupRetry = time.Now()
+}
+
+// restoredOwner starts the session cookies which are only known by their
+// digest, a cookie is never written into the storage backend
+const restoredOwner = "sha256:"
+
+// ownersRestored tells if some leases, tickets or bookings wait for their
+// session to come back
+var ownersRestored bool
+
+// ownerDigest returns what is written of a session cookie
+func ownerDigest(cookie string) string {
+	if cookie == "" || strings.HasPrefix(cookie, restoredOwner) {
+		return cookie
+	}
+	digest := sha256.Sum256([]byte(cookie))
+	return restoredOwner + hex.EncodeToString(digest[:])
+}
+
+// claimRestored gives a session cookie back what was restored for it
+// must be called from the pool goroutine
+func claimRestored(cookie string) {
+	if !ownersRestored || cookie == "" {
+		return
+	}
+	digest := ownerDigest(cookie)
+	for i := range ciServers.servers {
+		if ciServers.servers[i].currentOwner == digest {
+			ciServers.servers[i].currentOwner = cookie
+		}
+	}
+	for _, queue := range waitQueues {
+		for _, ticket := range queue {
+			if ticket.Owner == digest {
+				ticket.Owner = cookie
+			}
+		}
+	}
+	for i := range reservations {
+		if reservations[i].Cookie == digest {
+			reservations[i].Cookie = cookie
+		}
+	}
+}
@@ -2,17 +2,26 @@ package main
 
 import (
 	"base/base"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/spf13/viper"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,13 +34,28 @@ var StorageTCPPORT string
 //CredentialURI is read from config
 var CredentialURI string
 
-type cacheEntry struct {
+// session is a signed in user, the sessions are kept by the storage backend
+// under the digest of their cookie so that the cookies are never stored
+// Upercase is mandatory for JSON library parsing
+type session struct {
 	Nickname string
-	Cookie   string
 	Expire   time.Time
+	// Sessions opened with a key keep its scopes and end with it
+	Scopes    []string
+	AccessKey string
+	// Provider is set when the session was opened through an identity provider
+	Provider string
 }
 
-var cache []cacheEntry
+// sessions are the active sessions by cookie digest
+var sessions = make(map[string]session)
+var sessionsLock sync.Mutex
+
+// sessionsPruneInterval is the time between two scans for expired sessions
+var sessionsPruneInterval = 10 * time.Minute
+
+// sessionSameSite is the SameSite attribute of the session cookie
+var sessionSameSite = http.SameSiteLaxMode
 
 // Upercase is mandatory for JSON library parsing
 
@@ -53,6 +77,12 @@ type userPublic struct {
 	Email            string
 	EmailRW          string
 	EmailLABEL       string
+	Webhook          string
+	WebhookRW        string
+	WebhookLABEL     string
+	Role             string
+	RoleRW           string
+	RoleLABEL        string
 }
 
 //Initialize User config
@@ -72,7 +102,55 @@ func initUserconfig() error {
 	//StorageTCPPORT set from config file
 	StorageTCPPORT = viper.GetString("STORAGE_TCPPORT")
 	CredentialURI = viper.GetString("CREDENTIALS_TCPPORT")
-	return nil
+
+	if strings.EqualFold(viper.GetString("SESSION_SAMESITE"), "strict") {
+		sessionSameSite = http.SameSiteStrictMode
+	}
+
+	// OpenID Connect login
+	oidcIssuer = viper.GetString("OIDC_ISSUER")
+	oidcClientID = viper.GetString("OIDC_CLIENT_ID")
+	oidcClientSecret = viper.GetString("OIDC_CLIENT_SECRET")
+	oidcRedirectURL = viper.GetString("OIDC_REDIRECT_URL")
+	if viper.GetString("OIDC_NAME") != "" {
+		oidcName = viper.GetString("OIDC_NAME")
+	}
+	if viper.GetString("OIDC_SCOPES") != "" {
+		oidcScopes = viper.GetString("OIDC_SCOPES")
+	}
+	if viper.GetString("OIDC_NICKNAME_CLAIM") != "" {
+		oidcNicknameClaim = viper.GetString("OIDC_NICKNAME_CLAIM")
+	}
+	if viper.IsSet("OIDC_LINK_EMAIL") {
+		oidcLinkEmail = viper.GetBool("OIDC_LINK_EMAIL")
+	}
+
+	// LDAP authentication
+	ldapURL = viper.GetString("LDAP_URL")
+	ldapStartTLS = viper.GetBool("LDAP_STARTTLS")
+	ldapCAFile = viper.GetString("LDAP_CA_FILE")
+	ldapBindDN = viper.GetString("LDAP_BIND_DN")
+	ldapBindPassword = viper.GetString("LDAP_BIND_PASSWORD")
+	ldapBaseDN = viper.GetString("LDAP_BASE_DN")
+	if viper.GetString("LDAP_USER_FILTER") != "" {
+		ldapUserFilter = viper.GetString("LDAP_USER_FILTER")
+	}
+	if viper.GetString("LDAP_EMAIL_ATTRIBUTE") != "" {
+		ldapEmailAttribute = viper.GetString("LDAP_EMAIL_ATTRIBUTE")
+	}
+	if viper.GetString("LDAP_GROUP_ATTRIBUTE") != "" {
+		ldapGroupAttribute = viper.GetString("LDAP_GROUP_ATTRIBUTE")
+	}
+	ldapGroupBaseDN = viper.GetString("LDAP_GROUP_BASE_DN")
+	ldapGroupFilter = viper.GetString("LDAP_GROUP_FILTER")
+	ldapGroupRoles = viper.GetStringMapStringSlice("LDAP_GROUP_ROLES")
+
+	adminBootstrap = viper.GetString("ADMIN_BOOTSTRAP")
+	adminBootstrapPassword = viper.GetString("ADMIN_BOOTSTRAP_PASSWORD")
+	if viper.GetString("ADMIN_BOOTSTRAP_FILE") != "" {
+		adminBootstrapFile = viper.GetString("ADMIN_BOOTSTRAP_FILE")
+	}
+	return initLDAP()
 }
 
 func userExist(username string) bool {
@@ -116,6 +194,15 @@ func userGetInfo(nickname string) *userPublic {
 		returnValue.Email = tempValue.Email
 		returnValue.EmailLABEL = "Your primary email address. It won't be shared with anybody. Warning your email address must be verified each time you change it. During that process your account is disabled and can't be recovered without contacting us."
 		returnValue.EmailRW = "1"
+		returnValue.Webhook = tempValue.Webhook
+		returnValue.WebhookLABEL = "Optional http(s) URL called with a JSON payload when a server you are waiting for is held for you. Leave it empty to be notified only on the web page."
+		returnValue.WebhookRW = "1"
+		returnValue.Role = tempValue.Role
+		if returnValue.Role == "" {
+			returnValue.Role = base.RoleUser
+		}
+		returnValue.RoleRW = "0"
+		returnValue.RoleLABEL = "Operators manage the servers of every user, admins also manage the roles and the priorities of the users."
 	}
 
 	return returnValue
@@ -144,6 +231,8 @@ func updateAccount(username string, w http.ResponseWriter, r *http.Request) bool
 		CurrentPassword string
 		NewPassword0    string
 		NewPassword1    string
+		// nil when the client doesn't know about webhooks
+		Webhook *string
 	}
 	exist := userExist(username)
 	if !exist {
@@ -164,8 +253,20 @@ func updateAccount(username string, w http.ResponseWriter, r *http.Request) bool
 		return false
 	}
 
+	webhookChanged := false
+	if newData.Webhook != nil && strings.TrimSpace(*newData.Webhook) != updatedData.Webhook {
+		webhook := strings.TrimSpace(*newData.Webhook)
+		if webhook != "" && !validWebhook(webhook) {
+			w.Write([]byte("error webhook"))
+			return false
+		}
+		updatedData.Webhook = webhook
+		webhookChanged = true
+	}
+
 	if newData.CurrentPassword != "undefined" {
-		if !base.CheckPasswordHash(newData.CurrentPassword, updatedData.Password) {
+		// The password of a directory account is changed into the directory
+		if updatedData.LDAPDN != "" || !base.CheckPasswordHash(newData.CurrentPassword, updatedData.Password) {
 			w.Write([]byte("error password"))
 			return false
 		}
@@ -179,6 +280,12 @@ func updateAccount(username string, w http.ResponseWriter, r *http.Request) bool
 		}
 	}
 
+	if webhookChanged {
+		b, _ := json.Marshal(updatedData)
+		base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+updatedData.Nickname, b, "application/json")
+		serverReturn = serverReturn + "webhook"
+	}
+
 	// If the email address are different
 	if updatedData.Email != newData.Email {
 		// We must put the account into an inactive mode as long as the new email has not been validated
@@ -202,23 +309,99 @@ func updateAccount(username string, w http.ResponseWriter, r *http.Request) bool
 
 }
 
+// validWebhook tells if a webhook is an absolute http(s) URL of a public
+// host, the gateway checks the address again when it calls it
+func validWebhook(webhook string) bool {
+	target, err := url.Parse(webhook)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return false
+	}
+	addresses, err := net.LookupIP(target.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return false
+	}
+	for _, address := range addresses {
+		if !base.PublicIP(address) {
+			return false
+		}
+	}
+	return true
+}
+
+// newAccount returns a new inactive account with its default key pair
+func newAccount(nickname string, email string) *base.User {
+	account := new(base.User)
+	account.Nickname = nickname
+	account.Email = email
+	account.Keys = []base.APIKey{newKey(defaultKey)}
+	syncDefaultKey(account)
+	indexKey(account.TokenAuth, account.Nickname)
+	account.TokenType = "mac"
+	account.CreationDate = string(time.Now().Format(time.RFC1123Z))
+	account.Role = base.RoleUser
+	return account
+}
+
+// adminBootstrap names the admin account created at the first start
+var adminBootstrap string
+
+// adminBootstrapPassword is the password of that account, a random one is
+// written into adminBootstrapFile when it is empty
+var adminBootstrapPassword string
+var adminBootstrapFile = "/usr/local/production/config/adminPassword"
+
+// bootstrapAdmin creates the adminBootstrap account with the admin role if it
+// doesn't exist
+func bootstrapAdmin() {
+	if adminBootstrap == "" || userExist(adminBootstrap) {
+		return
+	}
+	if adminBootstrap == oidcProviderName || len(adminBootstrap) > 32 || nicknameFormat.MatchString(adminBootstrap) {
+		fmt.Printf("Can't create the admin account %s, its name is invalid\n", adminBootstrap)
+		return
+	}
+	password := adminBootstrapPassword
+	if password == "" {
+		// The password is only written once, only the service account can read it
+		password = base.GenerateAccountACKLink(24)
+		file, err := os.OpenFile(adminBootstrapFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Printf("Can't create the admin account %s: %s\n", adminBootstrap, err)
+			return
+		}
+		_, err = fmt.Fprintln(file, password)
+		file.Close()
+		if err != nil {
+			fmt.Printf("Can't create the admin account %s: %s\n", adminBootstrap, err)
+			return
+		}
+	}
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	account := newAccount(adminBootstrap, "")
+	account.Password, _ = base.HashPassword(password)
+	account.Active = 1
+	account.Role = base.RoleAdmin
+	b, _ := json.Marshal(account)
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+	if adminBootstrapPassword == "" {
+		fmt.Printf("Admin account %s created, its password is into %s\n", account.Nickname, adminBootstrapFile)
+	} else {
+		fmt.Printf("Admin account %s created\n", account.Nickname)
+	}
+}
+
 func createUser(username string, w http.ResponseWriter, r *http.Request) bool {
 	var updatedData *base.User
+	// The single sign-on requests are served under the provider name
 	exist := userExist(username)
-	if exist {
+	if exist || username == oidcProviderName {
 		fmt.Fprint(w, "Error")
 		return false
 	}
 
-	updatedData = new(base.User)
-	updatedData.Nickname = username
-	updatedData.Email = r.FormValue("email")
-
 	// this is a creation
-	updatedData.TokenAuth = base.GenerateAccountACKLink(20)
-	updatedData.TokenSecret = base.GenerateAuthToken("mac", 40)
-	updatedData.TokenType = "mac"
-	updatedData.CreationDate = string(time.Now().Format(time.RFC1123Z))
+	updatedData = newAccount(username, r.FormValue("email"))
 	updatedData.Password, _ = base.HashPassword(r.FormValue("password"))
 	updatedData.Lastlogin = ""
 	updatedData.Active = 0
@@ -261,6 +444,10 @@ func sendPasswordResetLink(username string, w http.ResponseWriter, r *http.Reque
 		return false
 	}
 	updatedData = userGetInternalInfo(username)
+	if updatedData.LDAPDN != "" {
+		http.Error(w, "403 Password is managed by the directory", 403)
+		return false
+	}
 	updatedData.ValidationString = base.GenerateAccountACKLink(24)
 	// The user can't be active as long as we do not have reset the password
 	updatedData.Active = 0
@@ -334,7 +521,11 @@ func deleteUser(username string, w http.ResponseWriter, r *http.Request) bool {
 	updatedData = userGetInternalInfo(username)
 	// if the received password is not the one of the end user we can't erase it's account
 	// might be a browser hack
-	if !base.CheckPasswordHash(newData.CurrentPassword, updatedData.Password) {
+	valid := base.CheckPasswordHash(newData.CurrentPassword, updatedData.Password)
+	if updatedData.LDAPDN != "" {
+		valid = ldapURL != "" && ldapCheckPassword(updatedData, newData.CurrentPassword)
+	}
+	if !valid {
 		w.Write([]byte("error password"))
 		return false
 	}
@@ -349,32 +540,807 @@ func deleteUser(username string, w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-func getSessionID(username string) string {
-	// We need to save the cookie into the user database (TODO)
-	// Is the user into the cache
-	for _, entry := range cache {
-		if entry.Nickname == username {
-			if entry.Expire.After(time.Now()) {
-				// Ok the Cookie is not expired
-				// We can return it and extend the lifecycle
-				entry.Expire = time.Now().Add(time.Second * time.Duration(base.MaxAge))
-				return (entry.Cookie)
+// sessionDigest is the name of a session into the store
+func sessionDigest(cookie string) string {
+	digest := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(digest[:])
+}
+
+// saveSession stores a session
+// must be called with sessionsLock held
+func saveSession(digest string, entry session) {
+	sessions[digest] = entry
+	b, _ := json.Marshal(entry)
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/session/"+digest, b, "application/json")
+}
+
+// dropSession forgets a session
+// must be called with sessionsLock held
+func dropSession(digest string) {
+	delete(sessions, digest)
+	base.HTTPDeleteRequest("http://" + StorageURI + StorageTCPPORT + "/session/" + digest)
+}
+
+// loadSessions reads the sessions kept by the storage backend, the users
+// stay signed in when the credential service restarts
+func loadSessions() {
+	var list []string
+	json.Unmarshal([]byte(base.HTTPGetRequest("http://"+StorageURI+StorageTCPPORT+"/session/")), &list)
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for _, digest := range list {
+		var entry session
+		content := base.HTTPGetRequest("http://" + StorageURI + StorageTCPPORT + "/session/" + digest)
+		if json.Unmarshal([]byte(content), &entry) != nil || !entry.Expire.After(time.Now()) {
+			dropSession(digest)
+			continue
+		}
+		sessions[digest] = entry
+	}
+	fmt.Printf("%d sessions restored\n", len(sessions))
+}
+
+// pruneSessions drops the expired sessions
+func pruneSessions() {
+	for {
+		time.Sleep(sessionsPruneInterval)
+		sessionsLock.Lock()
+		for digest, entry := range sessions {
+			if !entry.Expire.After(time.Now()) {
+				dropSession(digest)
 			}
 		}
+		sessionsLock.Unlock()
 	}
+}
 
-	// ok we must add an entry
+// dropKeySessions ends the sessions opened with a key which was rotated or revoked
+func dropKeySessions(accessKey string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for digest, entry := range sessions {
+		if entry.AccessKey == accessKey {
+			dropSession(digest)
+		}
+	}
+}
+
+// getSessionID returns the session cookie of a user, newEntry tells how the
+// session is opened and ends it earlier if its Expire is set. The session of
+// the cookie sent with the request is extended if it was opened the same way
+// by the same user, the servers it holds stay with it
+func getSessionID(r *http.Request, newEntry session) (string, time.Time) {
+	expire := time.Now().Add(time.Second * time.Duration(base.MaxAge))
+	if newEntry.Expire.IsZero() || newEntry.Expire.After(expire) {
+		newEntry.Expire = expire
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if current, err := r.Cookie("osfci_cookie"); err == nil && current.Value != "" {
+		digest := sessionDigest(current.Value)
+		if entry, ok := sessions[digest]; ok && entry.Expire.After(time.Now()) && entry.Nickname == newEntry.Nickname &&
+			entry.AccessKey == newEntry.AccessKey && entry.Provider == newEntry.Provider &&
+			strings.Join(entry.Scopes, ",") == strings.Join(newEntry.Scopes, ",") {
+			// Ok the Cookie is not expired
+			// We can return it and extend the lifecycle
+			saveSession(digest, newEntry)
+			return current.Value, newEntry.Expire
+		}
+	}
 
-	var newEntry cacheEntry
-	newEntry.Nickname = username
-	newEntry.Expire = time.Now().Add(time.Second * time.Duration(base.MaxAge))
+	// ok we must add an entry
 	Data := make([]byte, 32)
 	io.ReadFull(rand.Reader, Data)
 	cookie := base64.URLEncoding.EncodeToString(Data)
-	newEntry.Cookie = cookie
-	cache = append(cache, newEntry)
-	return (newEntry.Cookie)
+	saveSession(sessionDigest(cookie), newEntry)
+	return cookie, newEntry.Expire
+}
 
+// setSessionCookie sends the session cookie to the browser, it is only sent
+// over https and not with the requests coming from other sites
+func setSessionCookie(w http.ResponseWriter, sessionid string, expire time.Time) {
+	maxAge := -1
+	if sessionid != "" {
+		maxAge = int(time.Until(expire).Seconds())
+	}
+	cookie := http.Cookie{Name: "osfci_cookie", Value: sessionid, Path: "/", HttpOnly: true, MaxAge: maxAge,
+		Secure: true, SameSite: sessionSameSite}
+	http.SetCookie(w, &cookie)
+}
+
+// getSession returns the session of an active cookie
+func getSession(cookie string) (session, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	entry, ok := sessions[sessionDigest(cookie)]
+	return entry, ok && entry.Expire.After(time.Now())
+}
+
+// providerSession returns the identity provider which opened the session of
+// the cookie sent with a request, empty if the session is not one of username
+func providerSession(r *http.Request, username string) string {
+	current, err := r.Cookie("osfci_cookie")
+	if err != nil {
+		return ""
+	}
+	entry, ok := getSession(current.Value)
+	if !ok || entry.Nickname != username {
+		return ""
+	}
+	return entry.Provider
+}
+
+// getSessionOwner returns the nickname associated to an active session cookie
+func getSessionOwner(cookie string) string {
+	entry, ok := getSession(cookie)
+	if !ok {
+		return ""
+	}
+	return entry.Nickname
+}
+
+// logout ends the session of the cookie sent with the request
+func logout(username string, w http.ResponseWriter, r *http.Request) {
+	if current, err := r.Cookie("osfci_cookie"); err == nil && current.Value != "" {
+		digest := sessionDigest(current.Value)
+		sessionsLock.Lock()
+		if entry, ok := sessions[digest]; ok && entry.Nickname == username {
+			dropSession(digest)
+		}
+		sessionsLock.Unlock()
+	}
+	setSessionCookie(w, "", time.Now())
+	w.Write([]byte("ok"))
+}
+
+// sessionCallback is used by the gateway to identify the owner of a cookie
+// and the scopes of its session, it is not forwarded by the gateway
+//   GET /session/<cookie>
+//   GET /session/<cookie>/scopes
+func sessionCallback(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) < 3 || r.Method != http.MethodGet {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	if len(path) == 4 && path[3] == "scopes" {
+		entry, ok := getSession(path[2])
+		if !ok {
+			http.Error(w, "404 Unknown session", 404)
+			return
+		}
+		scopes := entry.Scopes
+		if scopes == nil {
+			scopes = []string{}
+		}
+		b, _ := json.Marshal(scopes)
+		w.Write(b)
+		return
+	}
+	w.Write([]byte(getSessionOwner(path[2])))
+}
+
+// accountCallback is used by the gateway to update the priority classes and
+// the role of a user, it is not forwarded by the gateway
+// path is /account/<nickname>/priority or /account/<nickname>/role
+func accountCallback(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) < 4 || r.Method != http.MethodPut {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	switch path[3] {
+	case "priority":
+		setPriority(path[2], w, r)
+	case "role":
+		setRole(path[2], w, r)
+	default:
+		http.Error(w, "401 Malformed URI", 401)
+	}
+}
+
+// setPriority changes the priority classes of a user
+func setPriority(nickname string, w http.ResponseWriter, r *http.Request) {
+	// Upercase is mandatory for JSON library parsing
+	type priorityUpdate struct {
+		Priority      string
+		TokenPriority string
+	}
+	var update priorityUpdate
+	if json.Unmarshal(base.HTTPGetBody(r), &update) != nil {
+		http.Error(w, "401 Malformed request", 401)
+		return
+	}
+	account := userGetInternalInfo(nickname)
+	if account == nil {
+		http.Error(w, "404 Unknown user", 404)
+		return
+	}
+	account.Priority = update.Priority
+	account.TokenPriority = update.TokenPriority
+	b, _ := json.Marshal(account)
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+	w.Write([]byte("ok"))
+}
+
+// setRole changes the role of a user
+func setRole(nickname string, w http.ResponseWriter, r *http.Request) {
+	// Upercase is mandatory for JSON library parsing
+	type roleUpdate struct {
+		Role string
+	}
+	var update roleUpdate
+	if json.Unmarshal(base.HTTPGetBody(r), &update) != nil || base.RoleRank(update.Role) == -1 {
+		http.Error(w, "401 Malformed request", 401)
+		return
+	}
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	account := userGetInternalInfo(nickname)
+	if account == nil {
+		http.Error(w, "404 Unknown user", 404)
+		return
+	}
+	if account.LDAPDN != "" && len(ldapGroupRoles) > 0 {
+		http.Error(w, "409 Role is given by the directory groups", 409)
+		return
+	}
+	account.Role = update.Role
+	b, _ := json.Marshal(account)
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+	w.Write([]byte("ok"))
+}
+
+// defaultKey is the name of the key pair given to the web interface by getToken
+const defaultKey = "default"
+
+// maxKeys is the number of key pairs a user can hold
+var maxKeys = 10
+
+// keyUseDelay is the time between two records of the last use of a key
+var keyUseDelay = time.Minute
+
+// keyNameFormat restricts the names of the key pairs
+var keyNameFormat = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// keysLock serializes the updates of the key pairs and of the second factor,
+// the gateway records the use of a key while the request it signed may be
+// changing the user record
+var keysLock sync.Mutex
+
+// newKey generates a key pair
+func newKey(name string) base.APIKey {
+	return base.APIKey{
+		Name:      name,
+		AccessKey: base.GenerateAccountACKLink(20),
+		SecretKey: base.GenerateAuthToken("mac", 40),
+		Created:   time.Now().Format(time.RFC1123Z),
+	}
+}
+
+// findKey returns the position of a key pair by name, -1 if there is none
+func findKey(account *base.User, name string) int {
+	for i := range account.Keys {
+		if account.Keys[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexKey records the owner of an access key into the storage backend
+func indexKey(accessKey string, nickname string) {
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/key/"+accessKey, []byte(nickname), "text/plain")
+}
+
+// unindexKey forgets an access key
+func unindexKey(accessKey string) {
+	base.HTTPDeleteRequest("http://" + StorageURI + StorageTCPPORT + "/key/" + accessKey)
+}
+
+// keyOwner returns the nickname owning an access key
+func keyOwner(accessKey string) string {
+	result := base.HTTPGetRequest("http://" + StorageURI + StorageTCPPORT + "/key/" + accessKey)
+	if result == "Error" {
+		return ""
+	}
+	return result
+}
+
+// migrateKeys turns the single key pair of the older accounts into the
+// default key, it returns true if the account must be saved
+func migrateKeys(account *base.User) bool {
+	if account.TokenAuth == "" {
+		return false
+	}
+	for _, key := range account.Keys {
+		if key.AccessKey == account.TokenAuth {
+			return false
+		}
+	}
+	legacy := base.APIKey{Name: defaultKey, AccessKey: account.TokenAuth, SecretKey: account.TokenSecret, Created: account.CreationDate}
+	account.Keys = append([]base.APIKey{legacy}, account.Keys...)
+	indexKey(legacy.AccessKey, account.Nickname)
+	return true
+}
+
+// syncDefaultKey mirrors the default key pair into TokenAuth and TokenSecret
+func syncDefaultKey(account *base.User) {
+	account.TokenAuth = ""
+	account.TokenSecret = ""
+	if i := findKey(account, defaultKey); i != -1 {
+		account.TokenAuth = account.Keys[i].AccessKey
+		account.TokenSecret = account.Keys[i].SecretKey
+	}
+}
+
+// signerKey returns the position of the key which signed a request, -1 if
+// the request was not signed by one of the keys of the account
+func signerKey(account *base.User, r *http.Request) int {
+	accessKey := r.Header.Get(base.VerifiedKeyHeader)
+	for i := range account.Keys {
+		if accessKey != "" && account.Keys[i].AccessKey == accessKey {
+			return i
+		}
+	}
+	return -1
+}
+
+// keyWithin tells if a key doesn't exceed the rights of the key managing it:
+// a scoped signer only manages keys of its scopes and an expiring one only
+// keys expiring before it
+func keyWithin(key base.APIKey, signer base.APIKey) bool {
+	if len(signer.Scopes) > 0 {
+		if len(key.Scopes) == 0 {
+			return false
+		}
+		for _, scope := range key.Scopes {
+			if !signer.Allows(scope) {
+				return false
+			}
+		}
+	}
+	if signer.Expires != "" {
+		signerExpires, _ := time.Parse(time.RFC1123Z, signer.Expires)
+		keyExpires, err := time.Parse(time.RFC1123Z, key.Expires)
+		if err != nil || keyExpires.After(signerExpires) {
+			return false
+		}
+	}
+	return true
+}
+
+// openKeySession opens a session for the key which signed a getToken
+// request, the session has the scopes of the key and expires with it
+func openKeySession(account *base.User, w http.ResponseWriter, r *http.Request) {
+	if account.Active == 0 {
+		http.Error(w, "401 User not activated Please check email", 401)
+		return
+	}
+	index := signerKey(account, r)
+	if index == -1 || account.Keys[index].Expired() || !account.Keys[index].Allows("session") {
+		http.Error(w, "403 Key can't open a session", 403)
+		return
+	}
+	key := account.Keys[index]
+	entry := session{Nickname: account.Nickname, Scopes: key.Scopes, AccessKey: key.AccessKey}
+	// The session doesn't outlive the key
+	if keyExpire, err := time.Parse(time.RFC1123Z, key.Expires); err == nil {
+		entry.Expire = keyExpire
+	}
+	sessionid, expire := getSessionID(r, entry)
+	setSessionCookie(w, sessionid, expire)
+	// The secret is never sent back, the robot already has it
+	b, _ := json.Marshal(map[string]interface{}{"accessKey": key.AccessKey, "scopes": key.Scopes, "expires": key.Expires})
+	w.Write(b)
+}
+
+// keysCommand manages the key pairs of a user
+//   GET    /user/<nickname>/keys         lists the keys without their secret
+//   POST   /user/<nickname>/keys/<name>  creates a key
+//   PUT    /user/<nickname>/keys/<name>  rotates a key, the old pair stops working
+//   DELETE /user/<nickname>/keys/<name>  revokes a key
+// The secret of a key is only returned when it is created or rotated. A key
+// is created with the scopes and the lifetime in hours of the JSON body
+//   { "Scopes" : [ "build", "firmware:read" ], "Lifetime" : 720 }
+// which are both optional. A rotated key keeps its scopes and lifetime, the
+// sessions opened with a rotated or revoked key end. A scoped or expiring
+// key only manages the keys within its rights (see keyWithin)
+func keysCommand(username string, w http.ResponseWriter, r *http.Request, name string) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	account := userGetInternalInfo(username)
+	if account == nil {
+		http.Error(w, "404 Unknown user", 404)
+		return
+	}
+	if account.Active == 0 {
+		http.Error(w, "401 User not activated Please check email", 401)
+		return
+	}
+	changed := migrateKeys(account)
+	var signer base.APIKey
+	if index := signerKey(account, r); index != -1 {
+		signer = account.Keys[index]
+	}
+	var returnData []byte
+	if r.Method == http.MethodGet {
+		// Upercase is mandatory for JSON library parsing
+		type keyInfo struct {
+			Name      string
+			AccessKey string
+			Created   string
+			LastUsed  string
+			Scopes    []string
+			Expires   string
+		}
+		list := []keyInfo{}
+		for _, key := range account.Keys {
+			list = append(list, keyInfo{key.Name, key.AccessKey, key.Created, key.LastUsed, key.Scopes, key.Expires})
+		}
+		returnData, _ = json.Marshal(list)
+	} else {
+		if !keyNameFormat.MatchString(name) {
+			http.Error(w, "401 Malformed key name", 401)
+			return
+		}
+		index := findKey(account, name)
+		switch r.Method {
+		case http.MethodPost:
+			if index != -1 {
+				http.Error(w, "409 Key "+name+" already exists", 409)
+				return
+			}
+			if len(account.Keys) >= maxKeys {
+				http.Error(w, fmt.Sprintf("409 At most %d keys per user", maxKeys), 409)
+				return
+			}
+			// Upercase is mandatory for JSON library parsing
+			type keyRequest struct {
+				Scopes   []string
+				Lifetime float64
+			}
+			var request keyRequest
+			if body := base.HTTPGetBody(r); len(body) > 0 && json.Unmarshal(body, &request) != nil {
+				http.Error(w, "401 Malformed request", 401)
+				return
+			}
+			if request.Lifetime < 0 {
+				http.Error(w, "401 Malformed key lifetime", 401)
+				return
+			}
+			key := newKey(name)
+			for _, scope := range request.Scopes {
+				if !base.ValidScope(scope) {
+					http.Error(w, "401 Unknown scope "+scope, 401)
+					return
+				}
+				key.Scopes = append(key.Scopes, scope)
+			}
+			if request.Lifetime > 0 {
+				key.Expires = time.Now().Add(time.Duration(request.Lifetime * float64(time.Hour))).Format(time.RFC1123Z)
+			}
+			if !keyWithin(key, signer) {
+				http.Error(w, "403 Key exceeds the rights of the signing key", 403)
+				return
+			}
+			account.Keys = append(account.Keys, key)
+			indexKey(key.AccessKey, account.Nickname)
+			returnData, _ = json.Marshal(key)
+		case http.MethodPut:
+			if index == -1 {
+				http.Error(w, "404 Unknown key", 404)
+				return
+			}
+			old := account.Keys[index]
+			if !keyWithin(old, signer) {
+				http.Error(w, "403 Key exceeds the rights of the signing key", 403)
+				return
+			}
+			key := newKey(name)
+			key.Scopes = old.Scopes
+			if old.Expires != "" {
+				key.Expires = old.Expires
+				created, errCreated := time.Parse(time.RFC1123Z, old.Created)
+				expires, errExpires := time.Parse(time.RFC1123Z, old.Expires)
+				if errCreated == nil && errExpires == nil {
+					key.Expires = time.Now().Add(expires.Sub(created)).Format(time.RFC1123Z)
+				}
+				// The rotated key doesn't outlive the key rotating it
+				if signer.Expires != "" && !keyWithin(key, base.APIKey{Expires: signer.Expires}) {
+					key.Expires = signer.Expires
+				}
+			}
+			unindexKey(old.AccessKey)
+			dropKeySessions(old.AccessKey)
+			account.Keys[index] = key
+			indexKey(key.AccessKey, account.Nickname)
+			returnData, _ = json.Marshal(account.Keys[index])
+		case http.MethodDelete:
+			if index == -1 {
+				http.Error(w, "404 Unknown key", 404)
+				return
+			}
+			if !keyWithin(account.Keys[index], signer) {
+				http.Error(w, "403 Key exceeds the rights of the signing key", 403)
+				return
+			}
+			unindexKey(account.Keys[index].AccessKey)
+			dropKeySessions(account.Keys[index].AccessKey)
+			account.Keys = append(account.Keys[:index], account.Keys[index+1:]...)
+			returnData = []byte("ok")
+		default:
+			http.Error(w, "401 Unknown request", 401)
+			return
+		}
+		syncDefaultKey(account)
+		changed = true
+	}
+	if changed {
+		b, _ := json.Marshal(account)
+		base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+	}
+	w.Write(returnData)
+}
+
+// keyCallback is used by the gateway to find the secret and the scopes of
+// an access key and to record its use, it is not forwarded by the gateway
+//   GET /key/<accessKey>?login=<nickname>
+//   PUT /key/<accessKey>/used
+// The login lets the accounts created before the keys were indexed migrate,
+// an expired key is unknown
+func keyCallback(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) < 3 || path[2] == "" {
+		http.Error(w, "401 Malformed URI", 401)
+		return
+	}
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	accessKey := path[2]
+	nickname := keyOwner(accessKey)
+	if nickname == "" && r.URL.Query().Get("login") != "" {
+		if account := userGetInternalInfo(r.URL.Query().Get("login")); account != nil && migrateKeys(account) {
+			b, _ := json.Marshal(account)
+			base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+			nickname = keyOwner(accessKey)
+		}
+	}
+	var account *base.User
+	if nickname != "" {
+		account = userGetInternalInfo(nickname)
+	}
+	index := -1
+	if account != nil && account.Active != 0 {
+		for i := range account.Keys {
+			if account.Keys[i].AccessKey == accessKey {
+				index = i
+			}
+		}
+	}
+	if index == -1 {
+		http.Error(w, "404 Unknown key", 404)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && len(path) == 3:
+		if account.Keys[index].Expired() {
+			http.Error(w, "404 Key expired", 404)
+			return
+		}
+		// Upercase is mandatory for JSON library parsing
+		type keySecret struct {
+			Nickname string
+			Role     string
+			base.APIKey
+		}
+		b, _ := json.Marshal(keySecret{account.Nickname, account.Role, account.Keys[index]})
+		w.Write(b)
+	case r.Method == http.MethodPut && len(path) == 4 && path[3] == "used":
+		lastUsed, err := time.Parse(time.RFC1123Z, account.Keys[index].LastUsed)
+		if err != nil || time.Since(lastUsed) > keyUseDelay {
+			account.Keys[index].LastUsed = time.Now().Format(time.RFC1123Z)
+			b, _ := json.Marshal(account)
+			base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+		}
+		w.Write([]byte("ok"))
+	default:
+		http.Error(w, "401 Malformed URI", 401)
+	}
+}
+
+// totpIssuer names the service into the authenticator applications
+var totpIssuer = "OSFCI"
+
+// totpSkew is the number of time steps a code can be late or early
+var totpSkew int64 = 1
+
+// recoveryCodesCount is the number of recovery codes given when the second factor is enabled
+var recoveryCodesCount = 10
+
+// maxSecondFactorFailures is the number of wrong codes after which a user
+// must wait secondFactorLockout before trying again
+var maxSecondFactorFailures = 5
+var secondFactorLockout = 5 * time.Minute
+
+// secondFactorFailure counts the wrong codes of a user
+type secondFactorFailure struct {
+	count int
+	last  time.Time
+}
+
+var secondFactorFailures = make(map[string]secondFactorFailure)
+var secondFactorLock sync.Mutex
+
+// newTOTPSecret generates the base32 secret of a second factor
+func newTOTPSecret() string {
+	data := make([]byte, 20)
+	io.ReadFull(rand.Reader, data)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data)
+}
+
+// newRecoveryCode generates a recovery code
+func newRecoveryCode() string {
+	data := make([]byte, 5)
+	io.ReadFull(rand.Reader, data)
+	code := hex.EncodeToString(data)
+	return code[:5] + "-" + code[5:]
+}
+
+// secondFactorLocked tells if a user gave too many wrong codes lately
+func secondFactorLocked(username string) bool {
+	secondFactorLock.Lock()
+	defer secondFactorLock.Unlock()
+	failure := secondFactorFailures[username]
+	return failure.count >= maxSecondFactorFailures && time.Since(failure.last) < secondFactorLockout
+}
+
+// recordSecondFactor counts a wrong code, a good one clears the count
+func recordSecondFactor(username string, valid bool) {
+	secondFactorLock.Lock()
+	defer secondFactorLock.Unlock()
+	if valid {
+		delete(secondFactorFailures, username)
+		return
+	}
+	failure := secondFactorFailures[username]
+	if time.Since(failure.last) >= secondFactorLockout {
+		failure.count = 0
+	}
+	failure.count++
+	failure.last = time.Now()
+	secondFactorFailures[username] = failure
+}
+
+// checkTOTP tells if a code is a TOTP code of a secret more recent than
+// lastStep and returns its time step
+func checkTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	now := base.TOTPStep(time.Now())
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := base.TOTPCode(secret, step)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkSecondFactor validates a TOTP or a recovery code of a user, the code
+// is used up into the account which must be saved by the caller
+func checkSecondFactor(account *base.User, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	valid := false
+	if len(code) == 6 {
+		var step int64
+		step, valid = checkTOTP(account.TOTPSecret, code, account.TOTPLastStep)
+		if valid {
+			account.TOTPLastStep = step
+		}
+	} else {
+		for i, hash := range account.RecoveryCodes {
+			if base.CheckPasswordHash(code, hash) {
+				account.RecoveryCodes = append(account.RecoveryCodes[:i], account.RecoveryCodes[i+1:]...)
+				valid = true
+				break
+			}
+		}
+	}
+	recordSecondFactor(account.Nickname, valid)
+	return valid
+}
+
+// totpCommand manages the second factor of a user
+//   GET  /user/<nickname>/totp          tells if it is enabled and the recovery codes left
+//   POST /user/<nickname>/totp/enrol    generates a secret, it is enabled once verified
+//   POST /user/<nickname>/totp/verify   enables it with code=<TOTP code>
+//   POST /user/<nickname>/totp/disable  disables it with code=<TOTP or recovery code>
+// The recovery codes are only returned when the second factor is enabled
+func totpCommand(username string, w http.ResponseWriter, r *http.Request, action string) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	account := userGetInternalInfo(username)
+	if account == nil {
+		http.Error(w, "404 Unknown user", 404)
+		return
+	}
+	if account.Active == 0 {
+		http.Error(w, "401 User not activated Please check email", 401)
+		return
+	}
+	if r.Method == http.MethodPost && action != "enrol" && secondFactorLocked(username) {
+		http.Error(w, "429 Too many wrong codes, please retry later", 429)
+		return
+	}
+	var returnData []byte
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		// Upercase is mandatory for JSON library parsing
+		type totpStatus struct {
+			Enabled       bool
+			RecoveryCodes int
+		}
+		returnData, _ = json.Marshal(totpStatus{account.TOTPEnabled, len(account.RecoveryCodes)})
+		w.Write(returnData)
+		return
+	case r.Method == http.MethodPost && action == "enrol":
+		if account.TOTPEnabled {
+			http.Error(w, "409 Second factor already enabled", 409)
+			return
+		}
+		account.TOTPSecret = newTOTPSecret()
+		uri := "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account.Nickname) + "?secret=" + account.TOTPSecret +
+			"&issuer=" + url.QueryEscape(totpIssuer) + "&algorithm=SHA1&digits=6&period=" + strconv.Itoa(base.TOTPPeriod)
+		returnData, _ = json.Marshal(map[string]string{"Secret": account.TOTPSecret, "URI": uri})
+	case r.Method == http.MethodPost && action == "verify":
+		if account.TOTPEnabled {
+			http.Error(w, "409 Second factor already enabled", 409)
+			return
+		}
+		if account.TOTPSecret == "" {
+			http.Error(w, "404 No second factor enrolled", 404)
+			return
+		}
+		step, valid := checkTOTP(account.TOTPSecret, strings.TrimSpace(r.FormValue("code")), 0)
+		recordSecondFactor(username, valid)
+		if !valid {
+			http.Error(w, "401 Second factor error", 401)
+			return
+		}
+		account.TOTPEnabled = true
+		account.TOTPLastStep = step
+		var codes []string
+		account.RecoveryCodes = nil
+		for i := 0; i < recoveryCodesCount; i++ {
+			code := newRecoveryCode()
+			hash, _ := base.HashPassword(code)
+			codes = append(codes, code)
+			account.RecoveryCodes = append(account.RecoveryCodes, hash)
+		}
+		returnData, _ = json.Marshal(map[string][]string{"RecoveryCodes": codes})
+	case r.Method == http.MethodPost && action == "disable":
+		if !account.TOTPEnabled {
+			http.Error(w, "409 Second factor not enabled", 409)
+			return
+		}
+		if !checkSecondFactor(account, r.FormValue("code")) {
+			http.Error(w, "401 Second factor error", 401)
+			return
+		}
+		account.TOTPEnabled = false
+		account.TOTPSecret = ""
+		account.TOTPLastStep = 0
+		account.RecoveryCodes = nil
+		returnData = []byte("ok")
+	default:
+		http.Error(w, "401 Unknown request", 401)
+		return
+	}
+	b, _ := json.Marshal(account)
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+	w.Write(returnData)
 }
 
 func getOpenBMC(username string, w http.ResponseWriter) {
@@ -429,6 +1395,27 @@ func userCallback(w http.ResponseWriter, r *http.Request) {
 	if len(path) >= 4 {
 		command = path[3]
 	}
+	// The key pairs are managed with every method
+	if command == "keys" {
+		name := ""
+		if len(path) >= 5 {
+			name = path[4]
+		}
+		keysCommand(username, w, r, name)
+		return
+	}
+	if username == oidcProviderName && strings.HasPrefix(command, "oidc") && r.Method == http.MethodGet {
+		ssoCommand(w, r, command)
+		return
+	}
+	if command == "totp" {
+		action := ""
+		if len(path) >= 5 {
+			action = path[4]
+		}
+		totpCommand(username, w, r, action)
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
 		switch command {
@@ -503,6 +1490,8 @@ func userCallback(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		// Ok I am getting there the various parameters to log a user
 		switch command {
+		case "logout":
+			logout(username, w, r)
 		case "getToken":
 			// We must get the user info and validate the password sent
 			// if the user doesn't have any API Token
@@ -510,15 +1499,78 @@ func userCallback(w http.ResponseWriter, r *http.Request) {
 			// if the user doesn't exist we need to deny the request
 			password := r.FormValue("password")
 			var result *base.User
+			// The directory is reached before the accounts are locked, a
+			// slow one must not hold the other logins and the key checks
+			var directoryUser ldapUser
+			var directoryErr error
+			if ldapURL != "" && password != "" {
+				if local := userGetInternalInfo(username); local == nil || local.LDAPDN != "" {
+					directoryUser, directoryErr = ldapAuthenticate(username, password)
+				}
+			}
+			keysLock.Lock()
+			defer keysLock.Unlock()
 			result = userGetInternalInfo(username)
-			if !base.CheckPasswordHash(password, result.Password) {
-				http.Error(w, "401 Password error", 401)
+			// A robot opens its session with the key which signed the request
+			if password == "" && result != nil && r.Header.Get(base.VerifiedKeyHeader) != "" {
+				openKeySession(result, w, r)
 				return
 			}
+			// The web interface gets the key pair of a session opened through
+			// the identity provider which checked the user itself
+			provider := ""
+			if password == "" && result != nil {
+				provider = providerSession(r, result.Nickname)
+			}
+			if provider == "" {
+				switch {
+				case ldapURL != "" && (result == nil || result.LDAPDN != ""):
+					// The directory checks the password of its accounts and
+					// provisions them at their first login
+					if directoryErr != nil && directoryErr != errLDAPCredentials {
+						fmt.Printf("Can't reach directory: %s\n", directoryErr)
+						http.Error(w, "503 Directory unavailable", 503)
+						return
+					}
+					account, err := ldapAccount(result, username, directoryUser)
+					if directoryErr != nil || err != nil {
+						http.Error(w, "401 Password error", 401)
+						return
+					}
+					result = account
+				case result == nil || !base.CheckPasswordHash(password, result.Password):
+					http.Error(w, "401 Password error", 401)
+					return
+				}
+			}
 			if result.Active == 0 {
 				http.Error(w, "401 User not activated Please check email", 401)
 				return
 			}
+			// The second factor is required once enabled
+			if result.TOTPEnabled && provider == "" {
+				if r.FormValue("otp") == "" {
+					http.Error(w, "401 Second factor required", 401)
+					return
+				}
+				if secondFactorLocked(result.Nickname) {
+					http.Error(w, "429 Too many wrong codes, please retry later", 429)
+					return
+				}
+				if !checkSecondFactor(result, r.FormValue("otp")) {
+					http.Error(w, "401 Second factor error", 401)
+					return
+				}
+			}
+			// The web interface always gets the default key pair
+			// it is generated again if it was revoked
+			migrateKeys(result)
+			if findKey(result, defaultKey) == -1 {
+				key := newKey(defaultKey)
+				result.Keys = append([]base.APIKey{key}, result.Keys...)
+				indexKey(key.AccessKey, result.Nickname)
+			}
+			syncDefaultKey(result)
 			// We have the right password !
 			// So, we need to send the secret and access token
 			// as the end user could login the to the API
@@ -532,10 +1584,9 @@ func userCallback(w http.ResponseWriter, r *http.Request) {
 			// As the user might be willing to use OpenBMC we need to send him also a SESSION ID cookie
 			// which will be the only way to track him/her as we eveolve from a single app web base
 			// platform to a multiple one (our website and the OpenBMC one)
-			sessionid := getSessionID(result.Nickname)
 			// We need to send back the cookie to the client
-			cookie := http.Cookie{Name: "osfci_cookie", Value: sessionid, Path: "/", HttpOnly: true, MaxAge: int(base.MaxAge)}
-			http.SetCookie(w, &cookie)
+			sessionid, expire := getSessionID(r, session{Nickname: result.Nickname, Provider: provider})
+			setSessionCookie(w, sessionid, expire)
 			fmt.Fprintf(w, string(returnValue))
 		case "createUser":
 			createUser(username, w, r)
@@ -570,6 +1621,12 @@ func main() {
 	mux := http.NewServeMux()
 	print("Attaching to " + CredentialURI + "\n")
 	// Serve one page site dynamic pages
+	loadSessions()
+	go pruneSessions()
+	bootstrapAdmin()
 	mux.HandleFunc("/user/", userCallback)
+	mux.HandleFunc("/session/", sessionCallback)
+	mux.HandleFunc("/account/", accountCallback)
+	mux.HandleFunc("/key/", keyCallback)
 	log.Fatal(http.ListenAndServe(CredentialURI, mux))
 }
@@ -0,0 +1,252 @@
+// OSFCI credential service - LDAP authentication
+//
+// Once LDAP_URL is set, getToken checks the passwords of the directory
+// accounts against an LDAP directory. The user is searched under
+// LDAP_BASE_DN with LDAP_USER_FILTER, as LDAP_BIND_DN or anonymously, then
+// its password is checked by binding as the user. Its account is created at
+// its first login. Local accounts keep their bcrypt password and are never
+// checked against the directory, a directory user can't log in as a local
+// account of the same name.
+// The role of a directory account follows its groups at each login when
+// LDAP_GROUP_ROLES is set. The groups are read from the LDAP_GROUP_ATTRIBUTE
+// of the user or searched with LDAP_GROUP_FILTER.
+
+package main
+
+import (
+	"base/base"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapURL is the ldap:// or ldaps:// URL of the directory, empty disables it
+var ldapURL string
+
+// ldapStartTLS upgrades an ldap:// connection to TLS
+var ldapStartTLS bool
+
+// ldapCAFile is the PEM file of the directory certificate authority when it
+// is not one of the system
+var ldapCAFile string
+
+// ldapTLS checks the certificate of the directory
+var ldapTLS *tls.Config
+
+// ldapBindDN and ldapBindPassword are the account searching the users, the
+// search is anonymous without it
+var ldapBindDN string
+var ldapBindPassword string
+
+var ldapBaseDN string
+
+// ldapUserFilter finds a user, %s is its nickname
+var ldapUserFilter = "(uid=%s)"
+
+var ldapEmailAttribute = "mail"
+var ldapGroupAttribute = "memberOf"
+
+// ldapGroupFilter finds the groups of a user under ldapGroupBaseDN, %s is its
+// DN. The groups are only read from ldapGroupAttribute while it is empty
+var ldapGroupBaseDN string
+var ldapGroupFilter string
+
+// ldapGroupRoles lists the group DNs giving each role
+var ldapGroupRoles map[string][]string
+
+// ldapTimeout bounds each exchange with the directory
+var ldapTimeout = 10 * time.Second
+
+// errLDAPCredentials is returned for an unknown user or a wrong password
+var errLDAPCredentials = errors.New("invalid credentials")
+
+// ldapUser is a user found into the directory
+type ldapUser struct {
+	dn     string
+	email  string
+	groups []string
+}
+
+// initLDAP checks the directory configuration
+func initLDAP() error {
+	if ldapURL == "" {
+		return nil
+	}
+	address, err := url.Parse(ldapURL)
+	if err != nil {
+		return err
+	}
+	if ldapGroupBaseDN == "" {
+		ldapGroupBaseDN = ldapBaseDN
+	}
+	ldapTLS = &tls.Config{ServerName: address.Hostname()}
+	if ldapCAFile != "" {
+		pem, err := ioutil.ReadFile(ldapCAFile)
+		if err != nil {
+			return err
+		}
+		ldapTLS.RootCAs = x509.NewCertPool()
+		if !ldapTLS.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate into %s", ldapCAFile)
+		}
+	}
+	if address.Scheme == "ldap" && !ldapStartTLS {
+		fmt.Printf("Warning: the passwords are sent in clear to %s\n", ldapURL)
+	}
+	for role := range ldapGroupRoles {
+		if base.RoleRank(role) == -1 {
+			fmt.Printf("Warning: LDAP_GROUP_ROLES gives the unknown role %s\n", role)
+		}
+	}
+	return nil
+}
+
+// ldapConnect opens a connection to the directory, it is bound with the
+// search account if there is one
+func ldapConnect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(ldapURL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(ldapTLS))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if ldapStartTLS {
+		if err = conn.StartTLS(ldapTLS); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if ldapBindDN != "" {
+		if err = conn.Bind(ldapBindDN, ldapBindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapFind returns the entry and the groups of a user
+func ldapFind(conn *ldap.Conn, nickname string) (ldapUser, error) {
+	var user ldapUser
+	filter := strings.Replace(ldapUserFilter, "%s", ldap.EscapeFilter(nickname), -1)
+	request := ldap.NewSearchRequest(ldapBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout/time.Second), false, filter, []string{ldapEmailAttribute, ldapGroupAttribute}, nil)
+	result, err := conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		fmt.Printf("Several directory users match %s\n", nickname)
+		return user, errLDAPCredentials
+	}
+	if err != nil {
+		return user, err
+	}
+	if len(result.Entries) != 1 {
+		return user, errLDAPCredentials
+	}
+	entry := result.Entries[0]
+	user.dn = entry.DN
+	user.email = entry.GetAttributeValue(ldapEmailAttribute)
+	user.groups = entry.GetAttributeValues(ldapGroupAttribute)
+	if ldapGroupFilter != "" {
+		filter = strings.Replace(ldapGroupFilter, "%s", ldap.EscapeFilter(entry.DN), -1)
+		request = ldap.NewSearchRequest(ldapGroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+			0, int(ldapTimeout/time.Second), false, filter, []string{"1.1"}, nil)
+		result, err = conn.Search(request)
+		if err != nil {
+			return user, err
+		}
+		for _, group := range result.Entries {
+			user.groups = append(user.groups, group.DN)
+		}
+	}
+	return user, nil
+}
+
+// ldapAuthenticate checks the password of a user by binding as the user
+func ldapAuthenticate(nickname string, password string) (ldapUser, error) {
+	// An empty password would be an anonymous bind which always succeeds
+	if password == "" || nickname == oidcProviderName || len(nickname) > 32 || nicknameFormat.MatchString(nickname) {
+		return ldapUser{}, errLDAPCredentials
+	}
+	conn, err := ldapConnect()
+	if err != nil {
+		return ldapUser{}, err
+	}
+	defer conn.Close()
+	user, err := ldapFind(conn, nickname)
+	if err != nil {
+		return user, err
+	}
+	err = conn.Bind(user.dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return user, errLDAPCredentials
+	}
+	return user, err
+}
+
+// ldapCheckPassword tells if a password is the one of a directory account
+func ldapCheckPassword(account *base.User, password string) bool {
+	user, err := ldapAuthenticate(account.Nickname, password)
+	return err == nil && sameDN(account.LDAPDN, user.dn)
+}
+
+// sameDN tells if two DNs name the same entry
+func sameDN(first string, second string) bool {
+	firstDN, err := ldap.ParseDN(first)
+	if err != nil {
+		return strings.EqualFold(first, second)
+	}
+	secondDN, err := ldap.ParseDN(second)
+	if err != nil {
+		return strings.EqualFold(first, second)
+	}
+	return firstDN.EqualFold(secondDN)
+}
+
+// ldapRole returns the highest role given by the groups of a user
+func ldapRole(groups []string) string {
+	for rank := len(base.Roles) - 1; rank > 0; rank-- {
+		role := base.Roles[rank]
+		for _, wanted := range ldapGroupRoles[role] {
+			for _, group := range groups {
+				if sameDN(group, wanted) {
+					return role
+				}
+			}
+		}
+	}
+	return base.RoleUser
+}
+
+// ldapAccount returns the account of a directory user whose password was
+// checked by ldapAuthenticate, account is nil when the user has none yet. The
+// email and the role of the account follow the directory, the caller saves
+// it. Must be called with keysLock held, the directory is not reached
+func ldapAccount(account *base.User, nickname string, user ldapUser) (*base.User, error) {
+	if user.dn == "" {
+		return nil, errLDAPCredentials
+	}
+	if account == nil {
+		account = newAccount(nickname, user.email)
+		account.Active = 1
+		account.LDAPDN = user.dn
+		fmt.Printf("Account %s created for %s\n", nickname, user.dn)
+	} else if !sameDN(account.LDAPDN, user.dn) {
+		fmt.Printf("Account %s belongs to %s, not to %s\n", nickname, account.LDAPDN, user.dn)
+		return nil, errLDAPCredentials
+	}
+	if user.email != "" {
+		account.Email = user.email
+	}
+	if len(ldapGroupRoles) > 0 {
+		account.Role = ldapRole(user.groups)
+	}
+	return account, nil
+}
@@ -0,0 +1,448 @@
+// OSFCI credential service - OpenID Connect login
+//
+// When OIDC_ISSUER is set the users can sign in through the identity
+// provider of the company instead of an osfci password:
+//   GET /user/sso/oidcProvider  tells the web interface the name of the provider
+//   GET /user/sso/oidcLogin     sends the browser to the provider
+//   GET /user/sso/oidcCallback  is where the provider sends the browser back
+// The callback exchanges the code of the provider for an ID token and checks
+// it. The account linked to the subject of the token is used, otherwise the
+// account named after the user is linked if it has the same verified email,
+// otherwise an account is created. Accounts created that way have no osfci
+// password and are active at once, the second factor is left to the provider.
+// The browser is then sent to /ci/?ssoLogin=1 with the session cookie and
+// the web interface gets the key pair of the account with getToken.
+
+package main
+
+import (
+	"base/base"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The client registered into the identity provider, the login is disabled
+// as long as oidcIssuer is empty
+var oidcIssuer string
+var oidcClientID string
+var oidcClientSecret string
+var oidcRedirectURL string
+
+// oidcName is the name of the provider shown on the login page
+var oidcName = "SSO"
+
+// oidcScopes are the scopes asked to the provider
+var oidcScopes = "openid email profile"
+
+// oidcNicknameClaim is the claim of the ID token naming the osfci account
+var oidcNicknameClaim = "preferred_username"
+
+// oidcLinkEmail links an existing account to a provider user with the same verified email
+var oidcLinkEmail = true
+
+// oidcProviderName is the account name of the single sign-on requests, no user can take it
+const oidcProviderName = "sso"
+
+// oidcLoginTimeout is the time a user has to sign in at the provider
+var oidcLoginTimeout = 10 * time.Minute
+
+// oidcClockSkew is the difference accepted between the provider clock and ours
+var oidcClockSkew = time.Minute
+
+// nicknameFormat restricts the nicknames of the accounts created through the provider
+var nicknameFormat = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// oidcConfiguration is the discovery document of the provider
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the claims of an ID token osfci uses
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	Expiration    int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified json.RawMessage `json:"email_verified"`
+	// every claim, oidcNicknameClaim names one of them
+	all map[string]interface{}
+}
+
+// oidcPending is a login started at the provider
+type oidcPending struct {
+	nonce    string
+	verifier string
+	expire   time.Time
+}
+
+// The discovery document and the signing keys are fetched at the first
+// login, the keys again when the provider signs with an unknown one
+var oidcProvider *oidcConfiguration
+var oidcKeys = make(map[string]*rsa.PublicKey)
+var oidcLock sync.Mutex
+
+var oidcPendings = make(map[string]oidcPending)
+var oidcPendingsLock sync.Mutex
+
+// oidcRandom returns a random URL safe value
+func oidcRandom() string {
+	data := make([]byte, 32)
+	io.ReadFull(rand.Reader, data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// oidcGet decodes the JSON document of an URL
+func oidcGet(uri string, document interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(document)
+}
+
+// discoverProvider returns the discovery document of the provider
+func discoverProvider() (*oidcConfiguration, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+	var configuration oidcConfiguration
+	err := oidcGet(strings.TrimSuffix(oidcIssuer, "/")+"/.well-known/openid-configuration", &configuration)
+	if err != nil {
+		return nil, err
+	}
+	if configuration.Issuer != oidcIssuer {
+		return nil, fmt.Errorf("provider issuer is %s instead of %s", configuration.Issuer, oidcIssuer)
+	}
+	oidcProvider = &configuration
+	return oidcProvider, nil
+}
+
+// providerKey returns the RSA key of the provider with a key id
+func providerKey(provider *oidcConfiguration, kid string) (*rsa.PublicKey, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if key, ok := oidcKeys[kid]; ok {
+		return key, nil
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := oidcGet(provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if jwk.Kty != "RSA" || errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	oidcKeys = keys
+	key, ok := oidcKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider key %s", kid)
+	}
+	return key, nil
+}
+
+// verifyIDToken checks the signature, the issuer, the audience, the
+// expiration and the nonce of an ID token and returns its claims
+func verifyIDToken(provider *oidcConfiguration, token string, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	content, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(content, &header) != nil {
+		return claims, errors.New("malformed ID token header")
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("ID token signed with %s", header.Alg)
+	}
+	key, err := providerKey(provider, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed ID token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return claims, errors.New("bad ID token signature")
+	}
+	content, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(content, &claims) != nil || json.Unmarshal(content, &claims.all) != nil {
+		return claims, errors.New("malformed ID token claims")
+	}
+	if claims.Issuer != oidcIssuer {
+		return claims, fmt.Errorf("ID token issued by %s", claims.Issuer)
+	}
+	var audience []string
+	if json.Unmarshal(claims.Audience, &audience) != nil {
+		var single string
+		json.Unmarshal(claims.Audience, &single)
+		audience = []string{single}
+	}
+	found := false
+	for _, client := range audience {
+		found = found || client == oidcClientID
+	}
+	if !found {
+		return claims, errors.New("ID token issued for another client")
+	}
+	if time.Now().Add(-oidcClockSkew).After(time.Unix(claims.Expiration, 0)) {
+		return claims, errors.New("ID token expired")
+	}
+	if claims.Nonce != nonce {
+		return claims, errors.New("ID token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return claims, errors.New("ID token without subject")
+	}
+	return claims, nil
+}
+
+// emailVerified tells if the provider checked the email of its user, some
+// providers send the claim as a string
+func (claims oidcClaims) emailVerified() bool {
+	value := strings.Trim(string(claims.EmailVerified), `"`)
+	return value == "true"
+}
+
+// nickname returns the osfci nickname of a provider user
+func (claims oidcClaims) nickname() string {
+	name, _ := claims.all[oidcNicknameClaim].(string)
+	if name == "" {
+		name = strings.Split(claims.Email, "@")[0]
+	}
+	name = nicknameFormat.ReplaceAllString(name, "")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// redirectURL is where the provider sends the browser back, it defaults to
+// the callback on the host the user came to
+func redirectURL(r *http.Request) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	return "https://" + r.Host + "/user/" + oidcProviderName + "/oidcCallback"
+}
+
+// exchangeCode gets the ID token of an authorization code
+func exchangeCode(provider *oidcConfiguration, code string, verifier string, redirect string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirect)
+	form.Set("code_verifier", verifier)
+	request, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&answer) != nil || resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %s %s", resp.Status, answer.Error)
+	}
+	if answer.IDToken == "" {
+		return "", errors.New("no ID token")
+	}
+	return answer.IDToken, nil
+}
+
+// providerAccount returns the account of a provider user, it is linked or
+// created if needed
+func providerAccount(claims oidcClaims) (string, error) {
+	subject := claims.Issuer + " " + claims.Subject
+	nickname := claims.nickname()
+	if nickname == "" || nickname == oidcProviderName {
+		return "", errors.New("the provider didn't give a user name")
+	}
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if userExist(nickname) {
+		account := userGetInternalInfo(nickname)
+		if account.OIDCSubject == subject {
+			return nickname, nil
+		}
+		// Only an account whose email was confirmed is linked, an inactive one
+		// may have been created by someone else with the email of the user
+		if account.OIDCSubject != "" || account.Active != 1 || !oidcLinkEmail || !claims.emailVerified() ||
+			claims.Email == "" || !strings.EqualFold(account.Email, claims.Email) {
+			return "", fmt.Errorf("the account %s belongs to someone else", nickname)
+		}
+		// The account is then only reached through the provider, a password
+		// is set again with a reset link
+		account.OIDCSubject = subject
+		account.Password = ""
+		b, _ := json.Marshal(account)
+		base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+		fmt.Printf("Account %s linked to %s\n", nickname, subject)
+		return nickname, nil
+	}
+	account := newAccount(nickname, claims.Email)
+	account.Active = 1
+	account.OIDCSubject = subject
+	b, _ := json.Marshal(account)
+	base.HTTPPutRequest("http://"+StorageURI+StorageTCPPORT+"/user/"+account.Nickname, b, "application/json")
+	fmt.Printf("Account %s created for %s\n", nickname, subject)
+	return nickname, nil
+}
+
+// oidcLogin sends the browser to the provider, the state is kept into a
+// cookie as to only accept the callback from the browser which started
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := discoverProvider()
+	if err != nil {
+		fmt.Printf("Can't reach identity provider: %s\n", err)
+		http.Error(w, "503 Identity provider unavailable", 503)
+		return
+	}
+	state := oidcRandom()
+	pending := oidcPending{nonce: oidcRandom(), verifier: oidcRandom(), expire: time.Now().Add(oidcLoginTimeout)}
+	oidcPendingsLock.Lock()
+	for key, login := range oidcPendings {
+		if time.Now().After(login.expire) {
+			delete(oidcPendings, key)
+		}
+	}
+	oidcPendings[state] = pending
+	oidcPendingsLock.Unlock()
+	challenge := sha256.Sum256([]byte(pending.verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", oidcClientID)
+	query.Set("redirect_uri", redirectURL(r))
+	query.Set("scope", oidcScopes)
+	query.Set("state", state)
+	query.Set("nonce", pending.nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	cookie := http.Cookie{Name: "osfci_oidc", Value: state, Path: "/user/" + oidcProviderName + "/", HttpOnly: true,
+		MaxAge: int(oidcLoginTimeout.Seconds()), Secure: true, SameSite: http.SameSiteLaxMode}
+	http.SetCookie(w, &cookie)
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// oidcCallback signs in the user the provider sends back
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if message := r.URL.Query().Get("error"); message != "" {
+		http.Error(w, "401 Identity provider refused the login: "+message, 401)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie("osfci_oidc")
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "401 Login was not started from this browser", 401)
+		return
+	}
+	oidcPendingsLock.Lock()
+	pending, ok := oidcPendings[state]
+	delete(oidcPendings, state)
+	oidcPendingsLock.Unlock()
+	if !ok || time.Now().After(pending.expire) {
+		http.Error(w, "401 Login expired, please retry", 401)
+		return
+	}
+	provider, err := discoverProvider()
+	if err != nil {
+		http.Error(w, "503 Identity provider unavailable", 503)
+		return
+	}
+	token, err := exchangeCode(provider, r.URL.Query().Get("code"), pending.verifier, redirectURL(r))
+	if err != nil {
+		fmt.Printf("Code exchange failed: %s\n", err)
+		http.Error(w, "401 Identity provider refused the login", 401)
+		return
+	}
+	claims, err := verifyIDToken(provider, token, pending.nonce)
+	if err != nil {
+		fmt.Printf("ID token refused: %s\n", err)
+		http.Error(w, "401 Identity provider refused the login", 401)
+		return
+	}
+	nickname, err := providerAccount(claims)
+	if err != nil {
+		http.Error(w, "409 "+err.Error(), 409)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "osfci_oidc", Value: "", Path: "/user/" + oidcProviderName + "/", MaxAge: -1})
+	sessionid, expire := getSessionID(r, session{Nickname: nickname, Provider: "oidc"})
+	setSessionCookie(w, sessionid, expire)
+	http.Redirect(w, r, "https://"+r.Host+"/ci/?ssoLogin=1&username="+url.QueryEscape(nickname), http.StatusFound)
+}
+
+// ssoCommand serves the single sign-on requests, path is /user/sso/<command>
+func ssoCommand(w http.ResponseWriter, r *http.Request, command string) {
+	if oidcIssuer == "" {
+		http.Error(w, "404 Single sign-on is not configured", 404)
+		return
+	}
+	switch command {
+	case "oidcProvider":
+		b, _ := json.Marshal(map[string]string{"Name": oidcName})
+		w.Write(b)
+	case "oidcLogin":
+		oidcLogin(w, r)
+	case "oidcCallback":
+		oidcCallback(w, r)
+	default:
+		http.Error(w, "401 Unknown request", 401)
+	}
+}